@@ -0,0 +1,425 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+	"github.com/MidhunRajeevan/s3-migration/util"
+	"github.com/h2non/filetype"
+)
+
+// archiveEntry is called for every regular file in an imported archive
+type archiveEntry func(name string, r io.Reader) error
+
+// importArchiveEntry stores one entry the way postUploads stores a file: named by
+// its SHA-256 with the original name kept in metadata. Entries are held to the
+// upload limit and the accepted types, the type coming from the content.
+func importArchiveEntry(ctx context.Context, objDir, tenant, name string, r io.Reader) (map[string]string, error) {
+	// Sniff the type from the first bytes before anything is spooled
+	head := make([]byte, 262)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if err = checkUploadType(ctx, objDir, name, "", head); err != nil {
+		return nil, err
+	}
+
+	// Spool to disk, the hash names the object so it is needed before the put
+	tmp, err := os.CreateTemp("", "archive-entry-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	limited := &uploadLimitReader{r: io.MultiReader(bytes.NewReader(head), r), limit: config.App.UploadLimit}
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), limited)
+	if errors.Is(err, errFileTooBig) {
+		logger(ctx).Warn("file_too_big", slog.String("name", name), slog.Int64("bytes", limited.n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if kind, _ := filetype.Match(head); kind.MIME.Value != "" {
+		contentType = kind.MIME.Value
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	objHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	objExt := path.Ext(name)
+	objName := fmt.Sprintf("%s/%s%s", objDir, objHash, objExt)
+	objFile := fmt.Sprintf("%s%s", objHash, objExt)
+	objURL := fmt.Sprintf("/%s/%s/uploads/%s", config.App.TenantString, tenant, objFile)
+
+	userMetadata := make(map[string]string)
+	userMetadata["name"] = url.QueryEscape(name)
+	userMetadata["hash"] = objHash
+	userMetadata["url"] = objURL
+
+	start := time.Now()
+	opts := storage.PutOptions{ContentType: contentType, Metadata: userMetadata}
+	put := func() error {
+		body, encodedSize, metadata, err := encodeObject(objDir, contentType, tmp, size, userMetadata)
+		if err != nil {
+			return err
+		}
+		opts.Metadata = metadata
+		_, err = config.TargetStore.Put(ctx, objName, body, encodedSize, opts)
+		return err
+	}
+	if config.App.Dedup {
+		_, err = putDeduplicated(ctx, objDir, objName, contentType, objHash, size, userMetadata["name"], objURL, put)
+	} else {
+		err = put()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger(ctx).Info("Archive entry stored", slog.String("key", objName), slog.Int64("bytes", size), slog.Duration("duration", time.Since(start)))
+	if err = ReplaceUploadDeletion(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+	}
+	return userMetadata, nil
+}
+
+// readTar walks a tar stream, transparently gunzipping it
+func readTar(r io.Reader, each archiveEntry) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = each(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readZip spools the body to disk, as the zip directory sits at the end
+func readZip(r io.Reader, each archiveEntry) error {
+	tmp, err := os.CreateTemp("", "archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = each(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archiveFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	switch r.Header.Get("Content-Type") {
+	case "application/zip", "application/x-zip-compressed":
+		return "zip"
+	default:
+		return "tar"
+	}
+}
+
+func postArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+	ctx = withLogger(ctx, slog.String("directory", objDir))
+	r = r.WithContext(ctx)
+
+	if !authorizeUpload(w, r, "import", objDir, "") {
+		return
+	}
+
+	var read func(io.Reader, archiveEntry) error
+	switch archiveFormat(r) {
+	case "tar":
+		read = readTar
+	case "zip":
+		read = readZip
+	default:
+		util.BadRequest(&w, "invalid_archive_format")
+		return
+	}
+
+	// Zip archives are spooled to disk whole, tar entries one at a time
+	body := http.MaxBytesReader(w, r.Body, config.App.ArchiveLimit)
+	response := make([]map[string]string, 0)
+	err = read(body, func(name string, entry io.Reader) error {
+		userMetadata, err := importArchiveEntry(ctx, objDir, segments[1], name, entry)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		response = append(response, userMetadata)
+		return nil
+	})
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		logger(ctx).Warn("archive_too_big", slog.Int64("limit", tooBig.Limit))
+		util.BadRequest(&w, "archive_too_big")
+		return
+	case errors.Is(err, errFileTooBig):
+		util.BadRequest(&w, "file_too_big")
+		return
+	case errors.Is(err, errContentNotAcceptable):
+		util.UnsupportedMediaType(&w, "content_not_acceptable", acceptedTypes(objDir))
+		return
+	case err != nil:
+		logger(ctx).Error("archive_import_error", slog.Int("imported", len(response)), slog.Any("error", err))
+		util.BadRequest(&w, "archive_import_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// exportEntryName returns a relative, unique name for a zip entry
+func exportEntryName(info storage.ObjectInfo, seen map[string]bool) string {
+	name := path.Base(info.Key)
+	if original, err := url.QueryUnescape(info.Metadata["name"]); err == nil && original != "" {
+		name = original
+	}
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if seen[name] {
+		// Same original name uploaded twice with different content
+		name = path.Join(path.Dir(name), info.Metadata["hash"]+"-"+path.Base(name))
+	}
+	seen[name] = true
+	return name
+}
+
+// writeArchiveEntry adds the content stored at key to the archive, named
+// after the reference when the content is deduplicated
+func writeArchiveEntry(ctx context.Context, zw *zip.Writer, key string, ref *BlobReference, seen map[string]bool) error {
+	rc, info, err := config.TargetStore.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	info = referencedInfo(info, ref)
+
+	body, err := decodeObject(rc, info)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     exportEntryName(info, seen),
+		Method:   zip.Deflate,
+		Modified: info.LastModified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}
+
+// exportDeleted reports whether a target key belongs to a deleted upload,
+// which is named by the source key when the key was rewritten
+func exportDeleted(deleted map[string]bool, key string) (bool, error) {
+	if len(deleted) == 0 {
+		return false, nil
+	}
+	if deleted[key] {
+		return true, nil
+	}
+	sourceKey, err := SelectSourceKey(key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return deleted[sourceKey], err
+}
+
+func getArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store := config.TargetStore
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+	ctx = withLogger(ctx, slog.String("directory", objDir))
+	r = r.WithContext(ctx)
+
+	if !authorizeUpload(w, r, "export", objDir, "") {
+		return
+	}
+
+	deletedKeys, err := SelectDeletedUploads(objDir)
+	if err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	}
+	deleted := make(map[string]bool, len(deletedKeys))
+	for _, key := range deletedKeys {
+		deleted[key] = true
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", objDir+".zip"))
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are sent, so failures from here on can only be logged and the
+	// archive left truncated
+	zw := zip.NewWriter(w)
+	seen := make(map[string]bool)
+	var count int
+	for object := range store.List(ctx, storage.ListOptions{Prefix: objDir + "/", Recursive: true}) {
+		if object.Err != nil {
+			logger(ctx).Error("archive_list_error", slog.Any("error", object.Err))
+			return
+		}
+		// Deduplicated content is exported through the references below, as
+		// a blob under the prefix may only be referenced by other directories
+		if _, err = SelectBlobByKey(object.Key); err == nil {
+			continue
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			logger(ctx).Error("archive_list_error", slog.String("key", object.Key), slog.Any("error", err))
+			return
+		}
+		if skip, err := exportDeleted(deleted, object.Key); err != nil {
+			logger(ctx).Error("archive_list_error", slog.String("key", object.Key), slog.Any("error", err))
+			return
+		} else if skip {
+			continue
+		}
+		if err = writeArchiveEntry(ctx, zw, object.Key, nil, seen); err != nil {
+			logger(ctx).Error("archive_write_error", slog.String("key", object.Key), slog.Any("error", err))
+			return
+		}
+		count++
+	}
+
+	// Deduplicated content of the directory may live under another prefix
+	references, err := SelectDirectoryBlobReferences(objDir)
+	if err != nil {
+		logger(ctx).Error("archive_list_error", slog.Any("error", err))
+		return
+	}
+	for _, ref := range references {
+		if skip, err := exportDeleted(deleted, ref.ObjectKey); err != nil {
+			logger(ctx).Error("archive_list_error", slog.String("key", ref.ObjectKey), slog.Any("error", err))
+			return
+		} else if skip {
+			continue
+		}
+		if err = writeArchiveEntry(ctx, zw, ref.BlobKey, &ref, seen); err != nil {
+			logger(ctx).Error("archive_write_error", slog.String("key", ref.BlobKey), slog.Any("error", err))
+			return
+		}
+		count++
+	}
+
+	if err = zw.Close(); err != nil {
+		logger(ctx).Error("archive_write_error", slog.Any("error", err))
+		return
+	}
+	logger(ctx).Info("Archive exported", slog.Int("files", count))
+}
+
+// Archives API
+func Archives(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if !(len(segments) == 2 && segments[0] == "archives") {
+		util.NotFound(&w, "path_not_found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet: // /archives/1
+		getArchive(w, r)
+	case http.MethodPost: // /archives/1
+		postArchive(w, r)
+	default:
+		util.MethodNotAllowed(&w, "method_not_allowed")
+	}
+}
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/envelope"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Metadata recording how an object was compressed and its original size,
+// prefixed so they do not collide with metadata of source objects
+const (
+	metaEncoding      = "gw-encoding"
+	metaDecodedLength = "gw-decoded-length"
+)
+
+// compressReader compresses src as it is read, without a goroutine, so an
+// abandoned put does not leak a writer
+type compressReader struct {
+	src   io.Reader
+	enc   io.WriteCloser
+	buf   bytes.Buffer
+	chunk [32 << 10]byte
+	eof   bool
+}
+
+func newCompressReader(src io.Reader, encoding string) (*compressReader, error) {
+	c := &compressReader{src: src}
+	switch encoding {
+	case "gzip":
+		c.enc = gzip.NewWriter(&c.buf)
+	case "zstd":
+		enc, err := zstd.NewWriter(&c.buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		c.enc = enc
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	return c, nil
+}
+
+func (c *compressReader) Read(p []byte) (int, error) {
+	for c.buf.Len() == 0 && !c.eof {
+		n, err := c.src.Read(c.chunk[:])
+		if n > 0 {
+			if _, werr := c.enc.Write(c.chunk[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+		if err == io.EOF {
+			if cerr := c.enc.Close(); cerr != nil {
+				return 0, cerr
+			}
+			c.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if c.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.buf.Read(p)
+}
+
+// compressForType applies the APP_COMPRESSION policy of the content type. The
+// compressed size is not known up front, so it is returned as -1.
+func compressForType(contentType string, r io.Reader, size int64, metadata map[string]string) (io.Reader, int64, map[string]string, error) {
+	encoding, ok := config.App.Compression[contentType]
+	if !ok || metadata[metaEncoding] != "" {
+		return r, size, metadata, nil
+	}
+
+	compressed, err := newCompressReader(r, encoding)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	merged := make(map[string]string, len(metadata)+2)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged[metaEncoding] = encoding
+	if size >= 0 {
+		merged[metaDecodedLength] = strconv.FormatInt(size, 10)
+	}
+	return compressed, -1, merged, nil
+}
+
+// decompress undoes the encoding recorded in the object metadata
+func decompress(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// encodeObject prepares content for the target of a directory: compressed by
+// content type first, as ciphertext does not compress, then encrypted
+func encodeObject(did, contentType string, r io.Reader, size int64, metadata map[string]string) (io.Reader, int64, map[string]string, error) {
+	r, size, metadata, err := compressForType(contentType, r, size, metadata)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return sealForDirectory(did, r, size, metadata)
+}
+
+// decodeObject returns the original content of a stored object
+func decodeObject(r io.Reader, info storage.ObjectInfo) (io.ReadCloser, error) {
+	plain, _, err := openObject(r, info)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(plain, info.Metadata[metaEncoding])
+}
+
+// decodedMetadata returns the user metadata of an object without the keys
+// encodeObject added
+func decodedMetadata(metadata map[string]string) map[string]string {
+	out := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		switch k {
+		case metaEncoding, metaDecodedLength,
+			envelope.MetaAlgorithm, envelope.MetaKey, envelope.MetaKeyID, envelope.MetaNonce:
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// allows the encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	return encodingWeight(r, encoding) > 0
+}
+
+// encodingWeight returns the weight the Accept-Encoding header of the request
+// gives a content coding, per RFC 9110 section 12.5.3: that of its own entry,
+// otherwise that of *, otherwise 1 for identity, which stays acceptable
+// unless excluded, and 0 for the others.
+func encodingWeight(r *http.Request, encoding string) float64 {
+	weight, wildcard := -1.0, -1.0
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			switch name = strings.TrimSpace(name); {
+			case strings.EqualFold(name, encoding):
+				weight = qValue(params)
+			case name == "*":
+				wildcard = qValue(params)
+			}
+		}
+	}
+	switch {
+	case weight >= 0:
+		return weight
+	case wildcard >= 0:
+		return wildcard
+	case strings.EqualFold(encoding, "identity"):
+		return 1
+	}
+	return 0
+}
+
+// qValue returns the weight in the parameters of an Accept-Encoding entry, 1
+// when there is none and 0 when it is invalid
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 || weight > 1 {
+			return 0
+		}
+		return weight
+	}
+	return 1
+}
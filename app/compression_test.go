@@ -0,0 +1,76 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   []string
+		encoding string
+		want     bool
+	}{
+		{"no header, identity", nil, "identity", true},
+		{"no header, gzip", nil, "gzip", false},
+		{"listed", []string{"gzip, deflate"}, "gzip", true},
+		{"case insensitive", []string{"GZip"}, "gzip", true},
+		{"not listed", []string{"deflate"}, "gzip", false},
+		{"not listed, identity", []string{"gzip"}, "identity", true},
+		{"weight", []string{"gzip;q=0.5"}, "gzip", true},
+		{"weight with spaces", []string{"gzip ; q = 0.5"}, "gzip", true},
+		{"refused", []string{"gzip;q=0"}, "gzip", false},
+		{"refused with decimals", []string{"gzip;q=0.000"}, "gzip", false},
+		{"invalid weight", []string{"gzip;q=high"}, "gzip", false},
+		{"weight out of range", []string{"gzip;q=2"}, "gzip", false},
+		{"wildcard", []string{"*"}, "zstd", true},
+		{"wildcard, identity", []string{"*"}, "identity", true},
+		{"refused wildcard", []string{"*;q=0"}, "gzip", false},
+		{"refused wildcard, identity", []string{"*;q=0"}, "identity", false},
+		{"entry wins over wildcard", []string{"gzip;q=0, *"}, "gzip", false},
+		{"entry wins over refused wildcard", []string{"gzip, *;q=0"}, "gzip", true},
+		{"identity and wildcard refused", []string{"identity;q=0, *;q=0"}, "identity", false},
+		{"identity refused", []string{"identity;q=0"}, "identity", false},
+		{"identity refused, others allowed", []string{"identity;q=0, *"}, "gzip", true},
+		{"several headers", []string{"deflate", "zstd"}, "zstd", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, value := range tt.header {
+				r.Header.Add("Accept-Encoding", value)
+			}
+			if got := acceptsEncoding(r, tt.encoding); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressReader(t *testing.T) {
+	content := strings.Repeat("compressible content ", 10000)
+	for _, encoding := range []string{"gzip", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			compressed, err := newCompressReader(strings.NewReader(content), encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plain, err := decompress(compressed, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer plain.Close()
+			got, err := io.ReadAll(plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != content {
+				t.Errorf("got %d bytes back, want %d", len(got), len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/envelope"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+var errNoCSEKey = errors.New("object is encrypted client-side but APP_CSE_KEY_FILE is not set")
+
+// sealForDirectory encrypts content written to a directory when client-side
+// encryption applies to it. It returns the reader, size and metadata to
+// store; content that is already encrypted passes through unchanged.
+func sealForDirectory(did string, r io.Reader, size int64, metadata map[string]string) (io.Reader, int64, map[string]string, error) {
+	if !config.CSE.Encrypts(did) || envelope.IsEncrypted(metadata) {
+		return r, size, metadata, nil
+	}
+
+	sealed, envelopeMetadata, err := envelope.Encrypt(config.CSE.Key, r)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	merged := make(map[string]string, len(metadata)+len(envelopeMetadata))
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	for k, v := range envelopeMetadata {
+		merged[k] = v
+	}
+	if size >= 0 {
+		size = envelope.EncryptedSize(size)
+	}
+	return sealed, size, merged, nil
+}
+
+// openObject returns the plaintext of a stored object and its size
+func openObject(r io.Reader, info storage.ObjectInfo) (io.Reader, int64, error) {
+	if !envelope.IsEncrypted(info.Metadata) {
+		return r, info.Size, nil
+	}
+	if config.CSE.Key == nil {
+		return nil, 0, errNoCSEKey
+	}
+	plain, err := envelope.Decrypt(config.CSE.Key, r, info.Metadata)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plain, envelope.DecryptedSize(info.Size), nil
+}
+
+// plaintextSize returns the size of an object before compression and
+// encryption
+func plaintextSize(info storage.ObjectInfo) int64 {
+	if length, err := strconv.ParseInt(info.Metadata[metaDecodedLength], 10, 64); err == nil {
+		return length
+	}
+	if envelope.IsEncrypted(info.Metadata) {
+		return envelope.DecryptedSize(info.Size)
+	}
+	return info.Size
+}
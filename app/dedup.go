@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/envelope"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// objectHash returns the SHA-256 of a source object, from its metadata when
+// it was uploaded through postUploads, otherwise by reading it
+func objectHash(ctx context.Context, info storage.ObjectInfo) (string, error) {
+	if hash := info.Metadata["hash"]; hash != "" {
+		return hash, nil
+	}
+
+	var object io.ReadCloser
+	var err error
+	if source, ok := config.SourceStore.(storage.VersionedStore); ok && info.VersionID != "" {
+		object, _, err = source.GetVersion(ctx, info.Key, info.VersionID)
+	} else {
+		object, _, err = config.SourceStore.Get(ctx, info.Key)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer object.Close()
+
+	hasher := sha256.New()
+	if _, err = io.Copy(hasher, object); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// dedupKey returns the key content is deduplicated under: its hash, qualified
+// by the encoding policy of the directory for the content type, so content is
+// only shared between writers that would have stored it the same way. A
+// directory requiring client-side encryption never references a plaintext
+// copy, whatever another directory stored.
+func dedupKey(did, contentType, hash string) string {
+	var policy []string
+	if encoding, ok := config.App.Compression[contentType]; ok {
+		policy = append(policy, encoding)
+	}
+	if config.CSE.Encrypts(did) {
+		policy = append(policy, "cse:"+envelope.KeyID(config.CSE.Key))
+	}
+	if config.Target.SSE != "" {
+		policy = append(policy, "sse:"+config.Target.SSE)
+	}
+	if len(policy) == 0 {
+		return hash
+	}
+	return hash + "/" + strings.Join(policy, ",")
+}
+
+// putDeduplicated stores content once per hash and encoding policy on the
+// target. put writes the content under key and is skipped when the content is
+// already stored that way; key is then recorded as a reference for the
+// directory, with the name and URL it was uploaded under, as the metadata of
+// the stored content belongs to the first uploader. It returns the physical
+// key holding the content.
+func putDeduplicated(ctx context.Context, did, key, contentType, hash string, size int64, name, url string, put func() error) (string, error) {
+	hash = dedupKey(did, contentType, hash)
+	blobKey, err := SelectBlob(hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Never overwrite content other keys still reference
+		if other, err := SelectBlobByKey(key); err == nil && other != hash {
+			return "", fmt.Errorf("%s holds deduplicated content %s", key, other)
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+
+		if err = put(); err != nil {
+			return "", err
+		}
+		if blobKey, err = RegisterBlob(hash, key, size); err != nil {
+			return "", err
+		}
+		if blobKey != key {
+			// A concurrent writer registered the same content first
+			if err = config.TargetStore.Delete(ctx, key); err != nil {
+				logger(ctx).Warn("Failed to remove duplicate copy", slog.String("key", key), slog.Any("error", err))
+			}
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	orphan, err := AddBlobReference(did, key, hash, name, url)
+	if err != nil {
+		return "", err
+	}
+	removeOrphan(ctx, orphan)
+
+	if blobKey != key {
+		logger(ctx).Info("Duplicate content referenced", slog.String("key", key), slog.String("blob_key", blobKey))
+	}
+	return blobKey, nil
+}
+
+// referencedInfo returns info with the name and URL of a deduplicated key in
+// place of those of the stored content. info is returned unchanged when ref
+// is nil.
+func referencedInfo(info storage.ObjectInfo, ref *BlobReference) storage.ObjectInfo {
+	if ref == nil {
+		return info
+	}
+	metadata := make(map[string]string, len(info.Metadata)+2)
+	for k, v := range info.Metadata {
+		metadata[k] = v
+	}
+	metadata["name"] = ref.Name
+	metadata["url"] = ref.URL
+	info.Metadata = metadata
+	return info
+}
+
+// deleteDeduplicated drops the reference held by key and deletes the stored
+// content once nothing references it any more
+func deleteDeduplicated(ctx context.Context, key string) error {
+	orphan, err := ReleaseBlobReference(key)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Not deduplicated, the key is the content
+		return config.TargetStore.Delete(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+	removeOrphan(ctx, orphan)
+	return nil
+}
+
+func removeOrphan(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := config.TargetStore.Delete(ctx, key); err != nil {
+		logger(ctx).Error("Failed to delete unreferenced content", slog.String("key", key), slog.Any("error", err))
+		return
+	}
+	logger(ctx).Info("Unreferenced content deleted", slog.String("key", key))
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// testDatabaseURL names a lib/pq connection string, key=value or URL, of a
+// PostgreSQL database the tests may create schemas in. Tests of code reading
+// the database are skipped without it, test/run.sh starts one and sets it.
+const testDatabaseURL = "TEST_DATABASE_URL"
+
+func init() {
+	config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// withAppConfig restores config.App and config.RewriteRules after the test
+func withAppConfig(t *testing.T) {
+	t.Helper()
+	app, rules := config.App, config.RewriteRules
+	t.Cleanup(func() {
+		config.App, config.RewriteRules = app, rules
+	})
+	config.App.ContentTypes = []string{"image/jpeg", "image/jpg", "image/png", "image/gif", "application/pdf", "application/octet-stream"}
+	config.App.TenantContentTypes = map[string][]string{}
+	config.App.Compression = map[string]string{}
+	config.App.TenantString = "tenants"
+	config.App.UploadLimit = 1 << 20
+}
+
+// newTestStores points the source and the target at empty FSStores for the
+// duration of the test
+func newTestStores(t *testing.T) (source, target *storage.FSStore) {
+	t.Helper()
+	var err error
+	if source, err = storage.NewFSStore(t.TempDir()); err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	if target, err = storage.NewFSStore(t.TempDir()); err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	sourceStore, targetStore := config.SourceStore, config.TargetStore
+	t.Cleanup(func() {
+		config.SourceStore, config.TargetStore = sourceStore, targetStore
+	})
+	config.SourceStore, config.TargetStore = source, target
+	return source, target
+}
+
+// newTestDB points config.DB at a fresh schema set up like the service does,
+// dropped after the test
+func newTestDB(t *testing.T) {
+	t.Helper()
+	connStr := os.Getenv(testDatabaseURL)
+	if connStr == "" {
+		t.Skipf("%s is not set", testDatabaseURL)
+	}
+
+	admin, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err = admin.Exec("create schema " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("drop schema " + schema + " cascade")
+	})
+
+	// lib/pq sends unknown settings as run-time parameters
+	if strings.Contains(connStr, "://") {
+		u, err := url.Parse(connStr)
+		if err != nil {
+			t.Fatalf("%s: %v", testDatabaseURL, err)
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		connStr = u.String()
+	} else {
+		connStr += " search_path=" + schema
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	previous := config.DB
+	t.Cleanup(func() {
+		db.Close()
+		config.DB = previous
+	})
+	config.DB = db
+	config.Setup()
+}
+
+func putObject(t *testing.T, store storage.ObjectStore, key, content string, opts storage.PutOptions) storage.ObjectInfo {
+	t.Helper()
+	info, err := store.Put(context.Background(), key, bytes.NewReader([]byte(content)), int64(len(content)), opts)
+	if err != nil {
+		t.Fatalf("Put %s: %v", key, err)
+	}
+	return info
+}
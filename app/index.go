@@ -4,7 +4,7 @@ import "net/http"
 
 // Index API
 func Index(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{ "app": "tars-upload-gateway" }`))
 }
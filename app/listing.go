@@ -0,0 +1,404 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+	"github.com/MidhunRajeevan/s3-migration/util"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+	// listScanFactor bounds the keys a filtered page scans, as a multiple
+	// of its limit, before it returns with what it found
+	listScanFactor = 10
+	// listStatWorkers stat the entries of a page concurrently
+	listStatWorkers = 16
+)
+
+// uploadItem is one entry of a listing
+type uploadItem struct {
+	Name         string         `json:"name"`
+	Size         int64          `json:"size"`
+	ContentType  string         `json:"contentType"`
+	LastModified time.Time      `json:"lastModified"`
+	Metadata     uploadMetadata `json:"metadata"`
+}
+
+// uploadFilter narrows a listing by content type and modification time
+type uploadFilter struct {
+	// ContentTypes match exactly, or by type with a wildcard like image/*
+	ContentTypes []string
+	After        time.Time
+	Before       time.Time
+}
+
+func (f uploadFilter) matchesTime(t time.Time) bool {
+	return (f.After.IsZero() || t.After(f.After)) && (f.Before.IsZero() || t.Before(f.Before))
+}
+
+func (f uploadFilter) matchesType(contentType string) bool {
+	if len(f.ContentTypes) == 0 {
+		return true
+	}
+	for _, accepted := range f.ContentTypes {
+		if prefix, ok := strings.CutSuffix(accepted, "/*"); ok {
+			if strings.HasPrefix(contentType, prefix+"/") {
+				return true
+			}
+		} else if contentType == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// statUploads resolves the entries like getUploadDetails does and returns
+// those matching the filter, in order. Entries gone since the listing are
+// left out.
+func statUploads(ctx context.Context, prefix string, objects []storage.ObjectInfo, filter uploadFilter) ([]uploadItem, error) {
+	items := make([]*uploadItem, len(objects))
+	errs := make([]error, len(objects))
+	sem := make(chan struct{}, listStatWorkers)
+	var wg sync.WaitGroup
+	for i, object := range objects {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, objName string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			store, objKey, ref, err := resolveUpload(ctx, objName)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			info, err := store.Stat(ctx, objKey)
+			if errors.Is(err, storage.ErrNotFound) {
+				return
+			}
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			info = referencedInfo(info, ref)
+			if !filter.matchesType(info.ContentType) || !filter.matchesTime(info.LastModified) {
+				return
+			}
+			items[i] = &uploadItem{
+				Name:         strings.TrimPrefix(objName, prefix),
+				Size:         plaintextSize(info),
+				ContentType:  info.ContentType,
+				LastModified: info.LastModified,
+				Metadata: uploadMetadata{
+					Hash: info.Metadata["hash"],
+					Name: info.Metadata["name"],
+					URL:  info.Metadata["url"],
+				},
+			}
+		}(i, object.Key)
+	}
+	wg.Wait()
+
+	var out []uploadItem
+	for i, item := range items {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if item != nil {
+			out = append(out, *item)
+		}
+	}
+	return out, nil
+}
+
+// listedKey is a key of a listing with where it was found
+type listedKey struct {
+	storage.ObjectInfo
+	onSource   bool
+	onTarget   bool
+	referenced bool
+}
+
+// listKeys merges the keys under prefix on the source and the target with
+// the keys the directory references in dedup mode, in key order and once each
+func listKeys(ctx context.Context, did, prefix, startAfter string) <-chan listedKey {
+	out := make(chan listedKey)
+	go func() {
+		defer close(out)
+
+		refs := make(chan storage.ObjectInfo)
+		go func() {
+			defer close(refs)
+			references, err := SelectDirectoryBlobReferences(did)
+			if err != nil {
+				select {
+				case refs <- storage.ObjectInfo{Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			for _, ref := range references {
+				if !strings.HasPrefix(ref.ObjectKey, prefix) || ref.ObjectKey <= startAfter {
+					continue
+				}
+				select {
+				case refs <- storage.ObjectInfo{Key: ref.ObjectKey}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		opts := storage.ListOptions{Prefix: prefix, Recursive: true, StartAfter: startAfter}
+		lists := []<-chan storage.ObjectInfo{
+			config.SourceStore.List(ctx, opts),
+			config.TargetStore.List(ctx, opts),
+			refs,
+		}
+		heads := make([]*storage.ObjectInfo, len(lists))
+		for {
+			next := -1
+			for i, list := range lists {
+				if heads[i] == nil && list != nil {
+					if info, ok := <-list; ok {
+						heads[i] = &info
+					} else {
+						lists[i] = nil
+					}
+				}
+				if heads[i] == nil {
+					continue
+				}
+				if heads[i].Err != nil {
+					select {
+					case out <- listedKey{ObjectInfo: *heads[i]}:
+					case <-ctx.Done():
+					}
+					return
+				}
+				if next < 0 || heads[i].Key < heads[next].Key {
+					next = i
+				}
+			}
+			if next < 0 {
+				return
+			}
+
+			key := listedKey{ObjectInfo: *heads[next]}
+			for i, head := range heads {
+				if head == nil || head.Key != key.Key {
+					continue
+				}
+				switch i {
+				case 0:
+					key.onSource = true
+				case 1:
+					key.onTarget = true
+				case 2:
+					key.referenced = true
+				}
+				if key.LastModified.IsZero() {
+					key.LastModified = head.LastModified
+				}
+				heads[i] = nil
+			}
+			select {
+			case out <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// listedName returns the upload name a listed key is read by, or "" when
+// the key is not an upload of the directory: content the directory no longer
+// references, or a target key outside of its prefix once rewritten back
+func listedName(key listedKey, prefix string) (string, error) {
+	if key.onSource {
+		return key.Key, nil
+	}
+	if !key.referenced {
+		if _, err := SelectBlobByKey(key.Key); err == nil {
+			return "", nil
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+	}
+	if len(config.RewriteRules) == 0 {
+		return key.Key, nil
+	}
+	sourceKey, err := SelectSourceKey(key.Key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key.Key, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(sourceKey, prefix) {
+		return "", nil
+	}
+	return sourceKey, nil
+}
+
+// listUploads pages through the uploads of a directory in key order. Keys
+// come from the directory prefix on the source and the target and from the
+// references of the directory, and each entry is resolved like a download.
+// The nextToken of a page continues the listing after its last key.
+func listUploads(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+	prefix := objDir + "/"
+	ctx = withLogger(ctx, slog.String("directory", objDir))
+
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if it := query.Get("limit"); it != "" {
+		if limit, err = strconv.Atoi(it); err != nil || limit < 1 || limit > maxListLimit {
+			util.BadRequest(&w, "invalid_limit")
+			return
+		}
+	}
+
+	startAfter := ""
+	if token := query.Get("token"); token != "" {
+		name, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			util.BadRequest(&w, "invalid_token")
+			return
+		}
+		startAfter = prefix + string(name)
+	}
+
+	var filter uploadFilter
+	for _, value := range query["contentType"] {
+		for _, contentType := range strings.Split(value, ",") {
+			if contentType = strings.TrimSpace(contentType); contentType != "" {
+				filter.ContentTypes = append(filter.ContentTypes, contentType)
+			}
+		}
+	}
+	if it := query.Get("modifiedAfter"); it != "" {
+		if filter.After, err = time.Parse(time.RFC3339, it); err != nil {
+			util.BadRequest(&w, "invalid_modified_after")
+			return
+		}
+	}
+	if it := query.Get("modifiedBefore"); it != "" {
+		if filter.Before, err = time.Parse(time.RFC3339, it); err != nil {
+			util.BadRequest(&w, "invalid_modified_before")
+			return
+		}
+	}
+
+	deletedKeys, err := SelectDeletedUploads(objDir)
+	if err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	}
+	deleted := make(map[string]bool, len(deletedKeys))
+	for _, key := range deletedKeys {
+		deleted[key] = true
+	}
+
+	// Entries passing the time filter are stat'ed in batches sized to what
+	// the page still needs, as only the stat returns the content type
+	items := []uploadItem{}
+	var batch []storage.ObjectInfo
+	var lastKey string
+	listed := make(map[string]bool)
+	scanned, more := 0, false
+	flush := func() error {
+		found, err := statUploads(ctx, prefix, batch, filter)
+		items = append(items, found...)
+		batch = nil
+		return err
+	}
+
+	for key := range listKeys(ctx, objDir, prefix, startAfter) {
+		if key.Err != nil {
+			logger(ctx).Error("list_objects_error", slog.Any("error", key.Err))
+			util.InternalServerError(&w, "list_objects_error")
+			return
+		}
+		scanned++
+		lastKey = key.Key
+		name, err := listedName(key, prefix)
+		if err != nil {
+			logger(ctx).Error("key_mapping_error", slog.Any("error", err))
+			util.InternalServerError(&w, "key_mapping_error")
+			return
+		}
+		// References carry no modification time, the stat checks it
+		if name != "" && !listed[name] && !deleted[name] && (key.LastModified.IsZero() || filter.matchesTime(key.LastModified)) {
+			// A renamed key is listed by its source name, which the source
+			// may still list as well
+			listed[name] = true
+			object := key.ObjectInfo
+			object.Key = name
+			batch = append(batch, object)
+		}
+		if len(items)+len(batch) == limit {
+			if err = flush(); err != nil {
+				logger(ctx).Error("get_object_error", slog.Any("error", err))
+				util.InternalServerError(&w, "get_object_error")
+				return
+			}
+			if len(items) == limit {
+				more = true
+				break
+			}
+		}
+		if scanned >= limit*listScanFactor {
+			more = true
+			break
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = flush(); err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.InternalServerError(&w, "get_object_error")
+		return
+	}
+
+	response := map[string]interface{}{
+		"items": items,
+	}
+	if more {
+		response["nextToken"] = base64.RawURLEncoding.EncodeToString([]byte(strings.TrimPrefix(lastKey, prefix)))
+	}
+	logger(ctx).Info("Uploads listed", slog.Int("items", len(items)), slog.Int("scanned", scanned))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
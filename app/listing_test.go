@@ -0,0 +1,207 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+func TestUploadFilter(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		filter      uploadFilter
+		contentType string
+		modified    time.Time
+		want        bool
+	}{
+		{"no filter", uploadFilter{}, "image/png", day, true},
+		{"exact type", uploadFilter{ContentTypes: []string{"image/png"}}, "image/png", day, true},
+		{"other type", uploadFilter{ContentTypes: []string{"image/png"}}, "image/jpeg", day, false},
+		{"one of several types", uploadFilter{ContentTypes: []string{"application/pdf", "image/png"}}, "image/png", day, true},
+		{"wildcard", uploadFilter{ContentTypes: []string{"image/*"}}, "image/jpeg", day, true},
+		{"wildcard of another type", uploadFilter{ContentTypes: []string{"image/*"}}, "application/pdf", day, false},
+		{"wildcard is not a prefix match", uploadFilter{ContentTypes: []string{"image/*"}}, "imagery/png", day, false},
+		{"after", uploadFilter{After: day.Add(-time.Hour)}, "image/png", day, true},
+		{"after is exclusive", uploadFilter{After: day}, "image/png", day, false},
+		{"before", uploadFilter{Before: day.Add(time.Hour)}, "image/png", day, true},
+		{"before is exclusive", uploadFilter{Before: day}, "image/png", day, false},
+		{"between", uploadFilter{After: day.Add(-time.Hour), Before: day.Add(time.Hour)}, "image/png", day, true},
+		{"type and time", uploadFilter{ContentTypes: []string{"image/png"}, After: day}, "image/png", day.Add(time.Hour), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.filter.matchesType(tt.contentType) && tt.filter.matchesTime(tt.modified)
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// listPage is a decoded listUploads response
+type listPage struct {
+	Items     []uploadItem `json:"items"`
+	NextToken string       `json:"nextToken"`
+}
+
+func listPageNames(page listPage) []string {
+	names := []string{}
+	for _, item := range page.Items {
+		names = append(names, item.Name)
+	}
+	return names
+}
+
+func getListPage(t *testing.T, query url.Values) listPage {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/tenants/ns:01/uploads?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	listUploads(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+	var page listPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatalf("decode listing: %v", err)
+	}
+	return page
+}
+
+func TestListUploads(t *testing.T) {
+	withAppConfig(t)
+	newTestDB(t)
+	source, target := newTestStores(t)
+
+	png := storage.PutOptions{ContentType: "image/png"}
+	pdf := storage.PutOptions{ContentType: "application/pdf"}
+	putObject(t, source, "ns-01/a.png", "a", png)
+	putObject(t, source, "ns-01/b.png", "b", png)
+	putObject(t, target, "ns-01/b.png", "b", png)
+	putObject(t, target, "ns-01/c.pdf", "c", pdf)
+	putObject(t, source, "ns-02/d.png", "d", png)
+
+	t.Run("pages", func(t *testing.T) {
+		var names []string
+		query := url.Values{"limit": {"2"}}
+		for pages := 0; ; pages++ {
+			if pages == 3 {
+				t.Fatalf("listing does not end, got %v", names)
+			}
+			page := getListPage(t, query)
+			names = append(names, listPageNames(page)...)
+			if page.NextToken == "" {
+				break
+			}
+			query.Set("token", page.NextToken)
+		}
+		if fmt.Sprint(names) != "[a.png b.png c.pdf]" {
+			t.Errorf("got %v, want each upload once, in order", names)
+		}
+	})
+
+	t.Run("content type", func(t *testing.T) {
+		page := getListPage(t, url.Values{"contentType": {"application/pdf"}})
+		if got := listPageNames(page); fmt.Sprint(got) != "[c.pdf]" || page.NextToken != "" {
+			t.Errorf("got %v, token %q", got, page.NextToken)
+		}
+		page = getListPage(t, url.Values{"contentType": {"image/*"}})
+		if got := listPageNames(page); fmt.Sprint(got) != "[a.png b.png]" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/tenants/ns:01/uploads?token=%21", nil)
+		w := httptest.NewRecorder()
+		listUploads(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestListUploadsScanCap(t *testing.T) {
+	withAppConfig(t)
+	newTestDB(t)
+	source, _ := newTestStores(t)
+
+	for i := 0; i < 2*listScanFactor; i++ {
+		putObject(t, source, fmt.Sprintf("ns-01/%02d.png", i), "x", storage.PutOptions{ContentType: "image/png"})
+	}
+	putObject(t, source, "ns-01/z.pdf", "z", storage.PutOptions{ContentType: "application/pdf"})
+
+	// A page scans at most limit*listScanFactor keys, and hands the rest
+	// to the next page rather than scanning on
+	query := url.Values{"limit": {"1"}, "contentType": {"application/pdf"}}
+	page := getListPage(t, query)
+	if len(page.Items) != 0 || page.NextToken == "" {
+		t.Fatalf("got %v, token %q, want an empty page to continue", listPageNames(page), page.NextToken)
+	}
+
+	var names []string
+	for pages := 0; page.NextToken != ""; pages++ {
+		if pages == 3 {
+			t.Fatalf("listing does not end, got %v", names)
+		}
+		query.Set("token", page.NextToken)
+		page = getListPage(t, query)
+		names = append(names, listPageNames(page)...)
+	}
+	if fmt.Sprint(names) != "[z.pdf]" {
+		t.Errorf("got %v, want [z.pdf]", names)
+	}
+}
+
+func TestListedName(t *testing.T) {
+	withAppConfig(t)
+	newTestDB(t)
+
+	if _, err := RegisterBlob("cafe", "ns-01/cafe.png", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordKeyMapping("ns-01/photo.png", "archive/1.png"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordKeyMapping("ns-02/photo.png", "archive/2.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rules bool
+		key   listedKey
+		want  string
+	}{
+		{"source key", true, listedKey{ObjectInfo: storage.ObjectInfo{Key: "ns-01/a.png"}, onSource: true}, "ns-01/a.png"},
+		{"target key", false, listedKey{ObjectInfo: storage.ObjectInfo{Key: "ns-01/a.png"}, onTarget: true}, "ns-01/a.png"},
+		{"reference", false, listedKey{ObjectInfo: storage.ObjectInfo{Key: "ns-01/a.png"}, referenced: true}, "ns-01/a.png"},
+		{"content of a reference", false, listedKey{ObjectInfo: storage.ObjectInfo{Key: "ns-01/cafe.png"}, onTarget: true}, ""},
+		{"renamed key without rules", false, listedKey{ObjectInfo: storage.ObjectInfo{Key: "archive/1.png"}, onTarget: true}, "archive/1.png"},
+		{"renamed key", true, listedKey{ObjectInfo: storage.ObjectInfo{Key: "archive/1.png"}, onTarget: true}, "ns-01/photo.png"},
+		{"renamed key of another directory", true, listedKey{ObjectInfo: storage.ObjectInfo{Key: "archive/2.png"}, onTarget: true}, ""},
+		{"key kept by the rules", true, listedKey{ObjectInfo: storage.ObjectInfo{Key: "ns-01/a.png"}, onTarget: true}, "ns-01/a.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.RewriteRules = nil
+			if tt.rules {
+				config.RewriteRules = []config.RewriteRule{{Type: "prefix", Match: "ns-01/", Replace: "archive/"}}
+			}
+			got, err := listedName(tt.key, "ns-01/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+)
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	jobKey
+	directionKey
+)
+
+// Job directions
+const (
+	// directionForward copies from the source to the target
+	directionForward = "forward"
+	// directionReverse copies from the target back to the source
+	directionReverse = "reverse"
+)
+
+// withLogger returns a context carrying a logger enriched with attrs
+func withLogger(ctx context.Context, attrs ...any) context.Context {
+	return context.WithValue(ctx, loggerKey, logger(ctx).With(attrs...))
+}
+
+// logger returns the request or job scoped logger, or the default one
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	if config.Logger != nil {
+		return config.Logger
+	}
+	return slog.Default()
+}
+
+// withJob returns a context carrying the job ID for logging and persistence
+func withJob(ctx context.Context, jobID int64) context.Context {
+	ctx = context.WithValue(ctx, jobKey, jobID)
+	return withLogger(ctx, slog.Int64("job_id", jobID))
+}
+
+// jobID returns the job the context belongs to, or 0 outside of a job
+func jobID(ctx context.Context) int64 {
+	id, _ := ctx.Value(jobKey).(int64)
+	return id
+}
+
+// withDirection returns a context carrying the copy direction of a job
+func withDirection(ctx context.Context, direction string) context.Context {
+	ctx = context.WithValue(ctx, directionKey, direction)
+	return withLogger(ctx, slog.String("direction", direction))
+}
+
+// jobDirection returns the copy direction of the context, forward by default
+func jobDirection(ctx context.Context) string {
+	if direction, ok := ctx.Value(directionKey).(string); ok {
+		return direction
+	}
+	return directionForward
+}
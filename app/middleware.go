@@ -0,0 +1,40 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/MidhunRajeevan/s3-migration/util"
+	"github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// RequestID tags the request with the caller's X-Request-ID, or a new one,
+// echoes it in the response and logs the request with it.
+func RequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := withLogger(r.Context(), slog.String("request_id", id))
+		logger(ctx).Info("Request", slog.String("method", r.Method), slog.String("path", r.URL.Path))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequireAdmin refuses requests that do not bear the admin token
+// (APP_ADMIN_TOKEN), and all requests when none is configured
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authorizeAdminToken(r, "admin", "", ""); err != nil {
+			logger(r.Context()).Warn("admin_forbidden", slog.String("path", r.URL.Path), slog.Any("error", err))
+			util.Forbidden(&w, "forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -2,24 +2,22 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"sync"
+	"time"
 
 	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
 	"github.com/minio/minio-go/v7"
 )
 
 var (
-	stopChan         = make(chan bool)
-	isRunning        = false
-	isPaused         = false
-	logFilePath      = "migration.log"
-	faildLogFilePath = "failed_files.log"
-	logFile          *os.File
-	logFileMutex     sync.Mutex
+	stopChan  = make(chan bool)
+	isRunning = false
+	isPaused  = false
 )
 
 func StartMigrationHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,14 +27,6 @@ func StartMigrationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := openLogFile()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to open log file"))
-		return
-	}
-	defer closeLogFile()
-
 	go startMigration()
 
 	w.WriteHeader(http.StatusOK)
@@ -56,179 +46,373 @@ func StopMigrationHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func startMigration() {
+	runMigration("migration", directionForward, migrateDirectories)
+}
+
+// runMigration records a job of the given kind and direction and executes run
+// until it returns or the stop handler is called
+func runMigration(kind, direction string, run func(ctx context.Context) error) {
 	isRunning = true
 	isPaused = false
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, err := CreateJob(kind, direction)
+	if err != nil {
+		logger(ctx).Error("Failed to create job", slog.String("kind", kind), slog.Any("error", err))
+		isRunning = false
+		return
+	}
+	ctx = withJob(ctx, id)
+	ctx = withDirection(ctx, direction)
+	ctx = withLogger(ctx, slog.String("kind", kind))
+	logger(ctx).Info("Job started")
 
 	go func() {
 		select {
 		case <-stopChan:
 			cancel()
 			isRunning = false
-			writeLog("Migration stopped")
+			logger(ctx).Info("Job stopped")
+		case <-ctx.Done():
 		}
 	}()
 
-	err := migrateDirectories(ctx)
-	if err != nil {
-		writeLog(fmt.Sprintf("Migration failed: %v", err))
-	} else {
-		writeLog("Migration completed successfully")
+	start := time.Now()
+	status := "completed"
+	err = run(ctx)
+	switch {
+	case errors.Is(err, context.Canceled):
+		status = "stopped"
+	case err != nil:
+		status = "failed"
+		logger(ctx).Error("Job failed", slog.Duration("duration", time.Since(start)), slog.Any("error", err))
+	default:
+		logger(ctx).Info("Job completed", slog.Duration("duration", time.Since(start)))
+	}
+	if err = MarkJobAsFinished(id, status); err != nil {
+		logger(ctx).Error("Failed to update job status", slog.Any("error", err))
 	}
 
 	isRunning = false
 }
 
 func migrateDirectories(ctx context.Context) error {
+	if config.App.Versions {
+		if _, _, err := versionedStores(); err != nil {
+			logger(ctx).Error("Versions cannot be migrated", slog.Any("error", err))
+			return err
+		}
+	}
+
 	directories, err := SelectDirectories()
 	if err != nil {
-		log.Println("Select directories Error:", err.Error())
+		logger(ctx).Error("Select directories Error", slog.Any("error", err))
 		return err
 	}
 
 	for _, dir := range directories {
 		select {
 		case <-ctx.Done():
-			log.Println("Migration stopped by context cancellation")
+			logger(ctx).Info("Migration stopped by context cancellation")
 			return ctx.Err()
 		default:
+			dirCtx := withLogger(ctx, slog.String("directory", dir.Did))
 			if DirectoryMigrated(dir.Did) {
-				log.Printf("Directory %s already migrated, skipping...", dir.Did)
+				logger(dirCtx).Info("Directory already migrated, skipping")
 				continue
 			}
-			err := MarkDirectoryAsStarted(dir)
+			err := MarkDirectoryAsStarted(dir, jobID(ctx))
 			if err != nil {
-				log.Printf("Failed to update directory start time for %s: %v", dir.Did, err)
+				logger(dirCtx).Error("Failed to update directory start time", slog.Any("error", err))
 				continue
 			}
-			log.Printf("Migrating directory: %s", dir.Did)
+			logger(dirCtx).Info("Migrating directory")
 
-			err = migrateFilesInDirectory(ctx, dir.Did)
+			start := time.Now()
+			migrate := migrateFilesInDirectory
+			if config.App.Versions {
+				migrate = migrateVersionsInDirectory
+			}
+			stats, err := migrate(dirCtx, dir.Did)
 			if err != nil {
-				log.Printf("Migration failed for directory %s: %v", dir.Did, err)
-				continue
+				logger(dirCtx).Error("Migration failed for directory", slog.Any("error", err))
+				if ctx.Err() != nil {
+					continue
+				}
+				// Listing failed, so whatever was copied is incomplete
+				stats.FailedFiles++
 			}
-			err = MarkDirectoryAsCompleted(dir.Did)
+			err = MarkDirectoryAsFinished(dir.Did, stats)
 			if err != nil {
-				log.Printf("Failed to update directory completion time for %s: %v", dir.Did, err)
+				logger(dirCtx).Error("Failed to update directory completion time", slog.Any("error", err))
+			}
+			// The source of a directory with failures stays whole
+			if config.App.Move && stats.Status() != "completed" {
+				n, err := SkipDirectoryDeletions(jobID(ctx), dir.Did, "directory "+stats.Status())
+				if err != nil {
+					logger(dirCtx).Error("Failed to skip source deletions", slog.Any("error", err))
+				} else if n > 0 {
+					logger(dirCtx).Warn("Source deletions skipped", slog.Int64("skipped", n))
+				}
 			}
 
-			log.Printf("Successfully migrated directory: %s", dir.Did)
+			logger(dirCtx).Info("Directory finished",
+				slog.String("status", stats.Status()),
+				slog.Int64("total_files", stats.TotalFiles),
+				slog.Int64("migrated_files", stats.MigratedFiles),
+				slog.Int64("failed_files", stats.FailedFiles),
+				slog.Int64("bytes", stats.Bytes),
+				slog.Duration("duration", time.Since(start)))
 		}
 	}
 
 	return nil
 }
 
-func migrateFilesInDirectory(ctx context.Context, directory string) error {
-	sourceClient := config.SourceClient
-	doneCh := make(chan struct{})
-	defer close(doneCh)
-
-	objectCh := sourceClient.ListObjects(ctx, config.Source.Bucket, minio.ListObjectsOptions{
+// migrateFilesInDirectory copies every object under the directory prefix and
+// returns the success and failure counts collected from the workers.
+func migrateFilesInDirectory(ctx context.Context, directory string) (DirectoryStats, error) {
+	objectCh := config.SourceStore.List(ctx, storage.ListOptions{
 		Prefix:    directory,
 		Recursive: true,
 	})
 
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stats DirectoryStats
 	for {
 		select {
 		case object, ok := <-objectCh:
 			if !ok {
 				wg.Wait() // Wait for all ongoing migrations to finish
-				return nil
+				return stats, nil
 			}
 			if object.Err != nil {
-				return object.Err
+				wg.Wait()
+				return stats, object.Err
 			}
 
+			mu.Lock()
+			stats.TotalFiles++
+			mu.Unlock()
+
 			wg.Add(1)
-			go func(object minio.ObjectInfo) {
+			go func(object storage.ObjectInfo) {
 				defer wg.Done()
 				select {
 				case <-ctx.Done():
 					return
 				default:
-					log.Printf("Migrating file: %s", object.Key)
-					err := migrateObject(object.Key)
+					objCtx := withLogger(ctx, slog.String("key", object.Key))
+					start := time.Now()
+					size, err := migrateObjectWithRetry(objCtx, directory, object.Key)
 					if err != nil {
-						log.Printf("Failed to migrate file %s: %v", object.Key, err)
-						logFailedFile(object.Key)
+						logFailedFile(objCtx, directory, object.Key, err)
+						mu.Lock()
+						stats.FailedFiles++
+						mu.Unlock()
 						return
 					}
 
-					markFileAsMigrated(object.Key)
+					mu.Lock()
+					stats.MigratedFiles++
+					stats.Bytes += size
+					mu.Unlock()
+					markFileAsMigrated(objCtx, size, time.Since(start))
 				}
 			}(object)
 		case <-ctx.Done():
 			wg.Wait() // Wait for all ongoing migrations to finish
-			return ctx.Err()
+			return stats, ctx.Err()
 		}
 	}
 }
 
-func migrateObject(objectKey string) error {
+// migrateObjectWithRetry attempts the copy up to config.App.Retries times,
+// backing off between attempts.
+func migrateObjectWithRetry(ctx context.Context, did, objectKey string) (int64, error) {
+	return withRetry(ctx, func() (int64, error) {
+		return migrateObject(ctx, did, objectKey)
+	})
+}
 
-	sourceClient := config.SourceClient
-	targetClient := config.TargetClient
-	ctx := context.Background()
+// withRetry runs attempt up to config.App.Retries times, backing off between
+// attempts, and returns the size of the first successful one
+func withRetry(ctx context.Context, attempt func() (int64, error)) (int64, error) {
+	var err error
+	var size int64
+	for n := 1; n <= config.App.Retries; n++ {
+		if size, err = attempt(); err == nil {
+			return size, nil
+		}
+		logger(ctx).Warn("Migration attempt failed",
+			slog.Int("attempt", n),
+			slog.String("error_code", errorCode(err)),
+			slog.Any("error", err))
+		// The bucket configuration will not change between attempts
+		if n == config.App.Retries || errors.Is(err, errRetentionNotPreserved) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return 0, err
+		case <-time.After(time.Duration(n) * time.Second):
+		}
+	}
+	return 0, err
+}
 
-	// Retrieve the object from Nuba S3
-	object, err := sourceClient.GetObject(ctx, config.Source.Bucket, objectKey, minio.GetObjectOptions{})
+// migrateObject copies one object, under its rewritten key when a rewrite
+// rule matches and in the storage class of the matching tiering rule, and
+// returns the number of bytes written. In dedup mode content already on the
+// target is referenced instead of copied again, in move mode the source is
+// scheduled for deletion.
+func migrateObject(ctx context.Context, did, objectKey string) (int64, error) {
+	// A stop request lets the copy in progress finish
+	ctx = context.WithoutCancel(ctx)
+
+	// Retrieve the object from the source
+	object, objInfo, err := config.SourceStore.Get(ctx, objectKey)
 	if err != nil {
-		return fmt.Errorf("failed to get object from Nuba S3: %v", err)
+		return 0, fmt.Errorf("failed to get object from source: %w", err)
 	}
 	defer object.Close()
 
-	// Get object info
-	objInfo, err := object.Stat()
+	targetKey, err := rewriteKey(ctx, objInfo)
 	if err != nil {
-		return fmt.Errorf("failed to stat object: %v", err)
+		return 0, fmt.Errorf("failed to rewrite key: %w", err)
+	}
+
+	// WORM objects must stay locked, a copy without the lock is not a migration
+	if !objInfo.Retention.IsZero() && !config.Target.ObjectLock {
+		return 0, fmt.Errorf("%w: object lock is not enabled on the target bucket", errRetentionNotPreserved)
 	}
 
-	// Put object to AWS S3
-	_, err = targetClient.PutObject(ctx, config.Target.Bucket, objectKey, object, objInfo.Size, minio.PutObjectOptions{ContentType: objInfo.ContentType})
+	// Compress and encrypt on the way as the policies require
+	body, size, metadata, err := encodeObject(did, objInfo.ContentType, object, objInfo.Size, objInfo.Metadata)
 	if err != nil {
-		return fmt.Errorf("failed to put object to AWS S3: %v", err)
+		return 0, fmt.Errorf("failed to encode object: %w", err)
 	}
 
-	return nil
-}
+	// Put object to the target
+	put := func() error {
+		_, err := config.TargetStore.Put(ctx, targetKey, body, size, targetPutOptions(did, objInfo, metadata))
+		if err != nil {
+			return fmt.Errorf("failed to put object to target: %w", err)
+		}
+		return nil
+	}
 
-func logFailedFile(objectKey string) {
-	file, err := os.OpenFile(faildLogFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Failed to open failed files log: %v", err)
+	blobKey := targetKey
+	if config.App.Dedup {
+		hash, err := objectHash(ctx, objInfo)
+		if err != nil {
+			return 0, fmt.Errorf("failed to hash object: %w", err)
+		}
+		if blobKey, err = putDeduplicated(ctx, did, targetKey, objInfo.ContentType, hash, objInfo.Size, objInfo.Metadata["name"], objInfo.Metadata["url"], put); err != nil {
+			return 0, err
+		}
+	} else if err = put(); err != nil {
+		return 0, err
 	}
-	defer file.Close()
 
-	if _, err := file.WriteString(fmt.Sprintf("Failed to migrate file: %s\n", objectKey)); err != nil {
-		log.Fatalf("Failed to write to failed files log: %v", err)
+	if err = verifyObject(ctx, blobKey, objInfo, blobKey != targetKey); err != nil {
+		return 0, err
+	}
+
+	// Keep old URLs resolvable after the rename. A moved key is mapped even
+	// when unchanged, as reads must go to the target once the source is gone.
+	if targetKey != objectKey || config.App.Move {
+		if err = RecordKeyMapping(objectKey, targetKey); err != nil {
+			return 0, fmt.Errorf("failed to record key mapping: %w", err)
+		}
+	}
+
+	// In move mode the verified source is deleted later by the sweeper, only
+	// once the mapping above sends reads to the target
+	if config.App.Move {
+		if err = ScheduleDeletion(jobID(ctx), did, objectKey, objInfo.ETag, blobKey, config.App.MoveGrace); err != nil {
+			return 0, fmt.Errorf("failed to schedule source deletion: %w", err)
+		}
 	}
-}
 
-func markFileAsMigrated(objectKey string) {
-	writeLog(fmt.Sprintf("File %s migrated", objectKey))
+	return objInfo.Size, nil
 }
 
-func openLogFile() error {
-	var err error
-	logFile, err = os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	return err
+// targetPutOptions carries the content type, retention and storage class of
+// a source object over to its copy, with the metadata of the encoded content
+func targetPutOptions(did string, source storage.ObjectInfo, metadata map[string]string) storage.PutOptions {
+	return storage.PutOptions{
+		ContentType:  source.ContentType,
+		Metadata:     metadata,
+		StorageClass: storageClass(did, source),
+		Retention:    source.Retention,
+	}
 }
 
-func closeLogFile() {
-	if logFile != nil {
-		logFile.Close()
+// errVerificationFailed marks objects whose copy does not match the source
+var errVerificationFailed = errors.New("verification failed")
+
+// errRetentionNotPreserved marks objects whose retention or legal hold could
+// not be carried over to the target
+var errRetentionNotPreserved = errors.New("retention not preserved")
+
+// verifyObject compares the copy on the target with the source object. Sizes
+// are compared as plaintext, as either side may be compressed or encrypted,
+// and the object lock state must match. Deduplicated content keeps the lock
+// state of the object that stored it first, so for a reference to it a
+// difference is only logged.
+func verifyObject(ctx context.Context, objectKey string, source storage.ObjectInfo, deduplicated bool) error {
+	target, err := config.TargetStore.Stat(ctx, objectKey)
+	if err != nil {
+		return fmt.Errorf("failed to stat object on target: %w", err)
 	}
+	if plaintextSize(target) != plaintextSize(source) {
+		return fmt.Errorf("%w: size %d, expected %d", errVerificationFailed, plaintextSize(target), plaintextSize(source))
+	}
+	if !target.Retention.Equal(source.Retention) {
+		if deduplicated {
+			logger(ctx).Warn("Retention of shared content differs",
+				slog.String("blob_key", objectKey),
+				slog.Any("retention", target.Retention),
+				slog.Any("expected", source.Retention))
+			return nil
+		}
+		return fmt.Errorf("%w: target has %+v, expected %+v", errRetentionNotPreserved, target.Retention, source.Retention)
+	}
+	return nil
 }
 
-func writeLog(message string) {
-	logFileMutex.Lock()
-	defer logFileMutex.Unlock()
+func logFailedFile(ctx context.Context, directory, objectKey string, cause error) {
+	code := errorCode(cause)
+	logger(ctx).Error("Failed to migrate file", slog.String("error_code", code), slog.Any("error", cause))
+	if err := RecordFailedObject(jobID(ctx), jobDirection(ctx), directory, objectKey, code, cause.Error()); err != nil {
+		logger(ctx).Error("Failed to record failed file", slog.Any("error", err))
+	}
+}
 
-	if logFile != nil {
-		logFile.WriteString(message + "\n")
-		logFile.Sync() // Ensure data is written to disk
+// errorCode extracts the S3 error code from a migration error
+func errorCode(err error) string {
+	var errResponse minio.ErrorResponse
+	if errors.As(err, &errResponse) && errResponse.Code != "" {
+		return errResponse.Code
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "Canceled"
+	}
+	if errors.Is(err, errVerificationFailed) {
+		return "VerificationFailed"
 	}
+	if errors.Is(err, errRetentionNotPreserved) {
+		return "RetentionNotPreserved"
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return "NoSuchKey"
+	}
+	return "InternalError"
+}
+
+func markFileAsMigrated(ctx context.Context, size int64, duration time.Duration) {
+	logger(ctx).Info("File migrated", slog.Int64("bytes", size), slog.Duration("duration", duration))
 }
@@ -3,9 +3,123 @@ package app
 import "time"
 
 type DirectoryRecord struct {
+	ID            int64     `json:"id"`
+	Did           string    `json:"did"`
+	Totalfiles    int64     `json:"totalFiles"`
+	MigratedFiles int64     `json:"migratedFiles"`
+	FailedFiles   int64     `json:"failedFiles"`
+	Bytes         int64     `json:"bytes"`
+	Status        string    `json:"status"`
+	StartedAt     time.Time `json:"startedAt"`
+	CompletedAt   time.Time `json:"completedAt"`
+}
+
+// DirectoryStats collected from the workers of one directory
+type DirectoryStats struct {
+	TotalFiles    int64
+	MigratedFiles int64
+	FailedFiles   int64
+	Bytes         int64
+}
+
+// Status derived from the success and failure counts
+func (s DirectoryStats) Status() string {
+	switch {
+	case s.FailedFiles == 0:
+		return "completed"
+	case s.MigratedFiles == 0:
+		return "failed"
+	default:
+		return "completed_with_errors"
+	}
+}
+
+type FailedObjectRecord struct {
+	ID           int64     `json:"id"`
+	Did          string    `json:"did"`
+	ObjectKey    string    `json:"objectKey"`
+	ErrorCode    string    `json:"errorCode"`
+	ErrorMessage string    `json:"errorMessage"`
+	Attempts     int       `json:"attempts"`
+	Status       string    `json:"status"`
+	Direction    string    `json:"direction"`
+	FailedAt     time.Time `json:"failedAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// statusPrefix distinguishes directory statuses written by rollback jobs
+func statusPrefix(direction string) string {
+	if direction == directionReverse {
+		return "rollback_"
+	}
+	return ""
+}
+
+// KeyMapping is a source key migrated to the target under TargetKey
+type KeyMapping struct {
+	SourceKey string `json:"sourceKey"`
+	TargetKey string `json:"targetKey"`
+}
+
+// BlobReference is a key referencing deduplicated content stored at BlobKey
+type BlobReference struct {
+	ObjectKey string `json:"objectKey"`
+	BlobKey   string `json:"blobKey"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+}
+
+// DeletionRecord is a source object scheduled for deletion in move mode
+type DeletionRecord struct {
 	ID          int64     `json:"id"`
+	JobID       int64     `json:"jobId"`
+	Did         string    `json:"did"`
+	SourceKey   string    `json:"sourceKey"`
+	SourceETag  string    `json:"sourceEtag"`
+	TargetKey   string    `json:"targetKey"`
+	Status      string    `json:"status"`
+	Message     string    `json:"message"`
+	DeleteAfter time.Time `json:"deleteAfter"`
+	DeletedAt   time.Time `json:"deletedAt"`
+}
+
+// UploadSession is an upload that spans several requests: a resumable upload
+// assembled from chunks (kind multipart) or an upload the client sends
+// straight to the bucket (kind presigned). HashState holds the SHA-256 of the
+// chunks received so far.
+type UploadSession struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
 	Did         string    `json:"did"`
-	Totalfiles  int64     `json:"totalFiles"`
+	Tenant      string    `json:"tenant"`
+	FileName    string    `json:"fileName"`
+	ContentType string    `json:"contentType"`
+	ObjectKey   string    `json:"-"`
+	UploadID    string    `json:"-"`
+	Length      int64     `json:"length"`
+	Offset      int64     `json:"offset"`
+	HashState   []byte    `json:"-"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// UploadDeletion is an upload deleted through the API. It can be restored
+// until PurgeAfter, when the content is removed.
+type UploadDeletion struct {
+	ID         int64     `json:"id"`
+	Did        string    `json:"did"`
+	ObjectKey  string    `json:"objectKey"`
+	Status     string    `json:"status"`
+	Message    string    `json:"message,omitempty"`
+	PurgeAfter time.Time `json:"purgeAfter"`
+	DeletedAt  time.Time `json:"deletedAt"`
+}
+
+type JobRecord struct {
+	ID          int64     `json:"id"`
+	Kind        string    `json:"kind"`
+	Direction   string    `json:"direction"`
 	Status      string    `json:"status"`
 	StartedAt   time.Time `json:"startedAt"`
 	CompletedAt time.Time `json:"completedAt"`
@@ -0,0 +1,24 @@
+package app
+
+import "testing"
+
+func TestDirectoryStatsStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats DirectoryStats
+		want  string
+	}{
+		{"empty directory", DirectoryStats{}, "completed"},
+		{"all migrated", DirectoryStats{TotalFiles: 3, MigratedFiles: 3, Bytes: 30}, "completed"},
+		{"some failed", DirectoryStats{TotalFiles: 3, MigratedFiles: 2, FailedFiles: 1, Bytes: 20}, "completed_with_errors"},
+		{"one migrated", DirectoryStats{TotalFiles: 3, MigratedFiles: 1, FailedFiles: 2, Bytes: 10}, "completed_with_errors"},
+		{"all failed", DirectoryStats{TotalFiles: 3, FailedFiles: 3}, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.stats.Status(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
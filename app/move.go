@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// sweepInterval between checks of the deletion journal
+const sweepInterval = time.Minute
+
+// sweepMu keeps sweeps from overlapping when one runs longer than the interval
+var sweepMu sync.Mutex
+
+// StartDeletionSweeper deletes, in move mode, the source objects whose grace
+// delay has passed. It returns immediately and sweeps in the background.
+func StartDeletionSweeper() {
+	if !config.App.Move {
+		return
+	}
+
+	ctx := withLogger(context.Background(), slog.String("kind", "deletion_sweep"))
+	logger(ctx).Info("Move mode enabled",
+		slog.Duration("grace", config.App.MoveGrace),
+		slog.Int("max_deletions", config.App.MoveLimit))
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepDeletions(ctx)
+		}
+	}()
+}
+
+// sweepDeletions deletes the due source objects, at most
+// config.App.MoveLimit per job. A job reaching the cap has its remaining
+// deletions held until the objects are migrated again.
+func sweepDeletions(ctx context.Context) {
+	sweepMu.Lock()
+	defer sweepMu.Unlock()
+
+	due, err := SelectDueDeletions(config.App.MoveLimit)
+	if err != nil {
+		logger(ctx).Error("Select due deletions Error", slog.Any("error", err))
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	counts := make(map[string]int)
+	jobDeleted := make(map[int64]int)
+	held := make(map[int64]bool)
+	for _, deletion := range due {
+		if held[deletion.JobID] {
+			continue
+		}
+		jobCtx := withLogger(ctx, slog.Int64("job_id", deletion.JobID))
+		deleted, ok := jobDeleted[deletion.JobID]
+		if !ok {
+			if deleted, err = CountJobDeletions(deletion.JobID); err != nil {
+				logger(jobCtx).Error("Count job deletions Error", slog.Any("error", err))
+				return
+			}
+		}
+		if deleted >= config.App.MoveLimit {
+			held[deletion.JobID] = true
+			n, err := HoldDeletions(deletion.JobID, "deletion cap reached")
+			if err != nil {
+				logger(jobCtx).Error("Failed to hold deletions", slog.Any("error", err))
+				continue
+			}
+			logger(jobCtx).Error("Deletion cap reached, remaining deletions of the job held",
+				slog.Int("deleted", deleted),
+				slog.Int64("held", n))
+			continue
+		}
+
+		delCtx := withLogger(jobCtx, slog.String("directory", deletion.Did), slog.String("key", deletion.SourceKey))
+		status, err := deleteSource(delCtx, deletion)
+		message := ""
+		if err != nil {
+			message = err.Error()
+			logger(delCtx).Warn("Source not deleted", slog.String("status", status), slog.Any("error", err))
+		} else {
+			logger(delCtx).Info("Source deleted")
+			deleted++
+		}
+		jobDeleted[deletion.JobID] = deleted
+		if err = MarkDeletion(deletion.ID, status, message); err != nil {
+			logger(delCtx).Error("Failed to update deletion journal", slog.Any("error", err))
+		}
+		counts[status]++
+	}
+
+	logger(ctx).Info("Deletion sweep finished",
+		slog.Int("deleted", counts["deleted"]),
+		slog.Int("changed", counts["changed"]),
+		slog.Int("missing", counts["missing"]),
+		slog.Int("failed", counts["failed"]))
+}
+
+// deleteSource removes a journaled source object after checking that it is
+// unchanged since the copy, that the copy is still valid and that reads are
+// mapped to it. It returns the journal status: deleted, changed, missing or
+// failed.
+func deleteSource(ctx context.Context, deletion DeletionRecord) (string, error) {
+	source, err := config.SourceStore.Stat(ctx, deletion.SourceKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "missing", err
+	}
+	if err != nil {
+		return "failed", err
+	}
+	if source.ETag != deletion.SourceETag {
+		return "changed", errors.New("source changed after it was migrated")
+	}
+	// Without a mapping reads would still go to the source
+	targetKey, err := SelectKeyMapping(deletion.SourceKey)
+	if err != nil {
+		return "failed", fmt.Errorf("failed to read key mapping: %w", err)
+	}
+	if err = verifyObject(ctx, deletion.TargetKey, source, deletion.TargetKey != targetKey); err != nil {
+		return "failed", err
+	}
+	if err = config.SourceStore.Delete(ctx, deletion.SourceKey); err != nil {
+		return "failed", err
+	}
+	return "deleted", nil
+}
@@ -0,0 +1,338 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/envelope"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+	"github.com/MidhunRajeevan/s3-migration/util"
+	"github.com/google/uuid"
+)
+
+// Presigned uploads let a client send the file straight to the bucket. The
+// file lands on a temporary key; the completion callback validates it and
+// stores it under its hash like postUploads does. Sessions never completed
+// are expired with their temporary object by the session expirer.
+
+// presignRequest is the body of a presigned upload request. Method is PUT
+// (default), which requires the length, or POST for a browser form.
+type presignRequest struct {
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	Length      int64  `json:"length"`
+	Method      string `json:"method"`
+}
+
+func postPresignedUpload(w http.ResponseWriter, r *http.Request, objDir string, store storage.PresignStore) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var req presignRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		util.BadRequest(&w, "invalid_request_body")
+		return
+	}
+	if req.FileName == "" {
+		util.BadRequest(&w, "file_name_required")
+		return
+	}
+	// The policy pins the declared type, so one is required
+	if req.ContentType == "" || checkDeclaredType(ctx, objDir, req.FileName, req.ContentType) != nil {
+		util.UnsupportedMediaType(&w, "content_not_acceptable", acceptedTypes(objDir))
+		return
+	}
+	// A PUT signs its Content-Length, so the length must be known up front
+	putMethod := req.Method == "" || strings.ToUpper(req.Method) == http.MethodPut
+	if req.Length < 0 || (putMethod && req.Length == 0) {
+		util.BadRequest(&w, "invalid_upload_length")
+		return
+	}
+	if req.Length > config.App.UploadLimit {
+		logger(ctx).Warn("file_too_big", slog.Int64("bytes", req.Length))
+		util.BadRequest(&w, "file_too_big")
+		return
+	}
+
+	session := UploadSession{
+		ID:          uuid.NewString(),
+		Kind:        "presigned",
+		Did:         objDir,
+		Tenant:      segments[1],
+		FileName:    req.FileName,
+		ContentType: req.ContentType,
+		Length:      req.Length,
+		Status:      "open",
+	}
+	session.ObjectKey = fmt.Sprintf(".uploads/%s", session.ID)
+
+	var presigned storage.PresignedRequest
+	var err error
+	switch strings.ToUpper(req.Method) {
+	case "", http.MethodPut:
+		presigned, err = store.PresignPut(ctx, session.ObjectKey, config.App.PresignExpiry, storage.PresignOptions{
+			ContentType: req.ContentType,
+			Size:        req.Length,
+		})
+	case http.MethodPost:
+		presigned, err = store.PresignPost(ctx, session.ObjectKey, config.App.PresignExpiry, storage.PresignOptions{
+			ContentType: req.ContentType,
+			MaxSize:     config.App.UploadLimit,
+		})
+	default:
+		util.BadRequest(&w, "invalid_method")
+		return
+	}
+	if errors.Is(err, storage.ErrPresignNotSupported) {
+		util.NotImplemented(&w, "presign_not_supported")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("presign_error", slog.Any("error", err))
+		util.InternalServerError(&w, "presign_error")
+		return
+	}
+
+	if err = CreateUploadSession(session); err != nil {
+		logger(ctx).Error("session_create_error", slog.Any("error", err))
+		util.InternalServerError(&w, "session_create_error")
+		return
+	}
+	logger(ctx).Info("Presigned upload issued", slog.String("session_id", session.ID), slog.String("method", presigned.Method))
+
+	response := map[string]interface{}{
+		"id":       session.ID,
+		"upload":   presigned,
+		"complete": fmt.Sprintf("/%s/%s/%s/presigned/%s", segments[0], segments[1], segments[2], session.ID),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// rejectPresignedUpload discards a temporary object that failed validation
+func rejectPresignedUpload(ctx context.Context, session UploadSession) {
+	if err := config.TargetStore.Delete(context.WithoutCancel(ctx), session.ObjectKey); err != nil {
+		logger(ctx).Warn("Temporary upload not removed", slog.String("key", session.ObjectKey), slog.Any("error", err))
+	}
+	if err := MarkUploadSession(session.ID, "rejected"); err != nil {
+		logger(ctx).Error("session_update_error", slog.Any("error", err))
+	}
+}
+
+// completePresignedUpload is called by the client once its upload finished.
+// The object is checked against the upload limit, the declared length and
+// type before it is stored under its hash.
+func completePresignedUpload(w http.ResponseWriter, r *http.Request, session UploadSession) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	store := config.TargetStore
+
+	if session.Status != "open" {
+		util.Conflict(&w, "session_closed")
+		return
+	}
+
+	objInfo, err := store.Stat(ctx, session.ObjectKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		util.Conflict(&w, "upload_incomplete")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.InternalServerError(&w, "get_object_error")
+		return
+	}
+	if objInfo.Size > config.App.UploadLimit {
+		logger(ctx).Warn("file_too_big", slog.Int64("bytes", objInfo.Size))
+		rejectPresignedUpload(ctx, session)
+		util.BadRequest(&w, "file_too_big")
+		return
+	}
+	if session.Length > 0 && objInfo.Size != session.Length {
+		logger(ctx).Warn("upload_length_mismatch", slog.Int64("bytes", objInfo.Size), slog.Int64("expected", session.Length))
+		rejectPresignedUpload(ctx, session)
+		util.BadRequest(&w, "upload_length_mismatch")
+		return
+	}
+
+	object, _, err := store.Get(ctx, session.ObjectKey)
+	if err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.InternalServerError(&w, "get_object_error")
+		return
+	}
+	defer object.Close()
+
+	head := make([]byte, 262)
+	n, err := io.ReadFull(object, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.InternalServerError(&w, "get_object_error")
+		return
+	}
+	head = head[:n]
+	if err = checkUploadType(ctx, session.Did, session.FileName, session.ContentType, head); err != nil {
+		rejectPresignedUpload(ctx, session)
+		util.UnsupportedMediaType(&w, "content_not_acceptable", acceptedTypes(session.Did))
+		return
+	}
+
+	hasher := sha256.New()
+	hasher.Write(head)
+	if _, err = io.Copy(hasher, object); err != nil {
+		logger(ctx).Error("hash_compute_error", slog.Any("error", err))
+		util.InternalServerError(&w, "hash_compute_error")
+		return
+	}
+	object.Close()
+
+	session.Length = objInfo.Size
+	objHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	urlPrefix := fmt.Sprintf("/%s/%s/%s", segments[0], segments[1], segments[2])
+	userMetadata, err := storeSessionUpload(ctx, session, urlPrefix, objHash)
+	if err != nil {
+		logger(ctx).Error("s3_put_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+		util.InternalServerError(&w, "s3_put_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(userMetadata)
+}
+
+// PresignedUploads API
+func PresignedUploads(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	store, ok := config.TargetStore.(storage.PresignStore)
+	if !ok {
+		util.NotImplemented(&w, "presign_not_supported")
+		return
+	}
+
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+	r = r.WithContext(withLogger(ctx, slog.String("directory", objDir)))
+
+	if r.Method != http.MethodPost {
+		util.MethodNotAllowed(&w, "method_not_allowed")
+		return
+	}
+
+	switch len(segments) {
+	case 4: // /tenants/1/uploads/presigned
+		postPresignedUpload(w, r, objDir, store)
+		return
+	case 5: // /tenants/1/uploads/presigned/1
+	default:
+		util.NotFound(&w, "path_not_found")
+		return
+	}
+
+	session, err := SelectUploadSession(segments[4])
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (session.Did != objDir || session.Kind != "presigned")) {
+		util.NotFound(&w, "session_not_found")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("session_select_error", slog.Any("error", err))
+		util.InternalServerError(&w, "session_select_error")
+		return
+	}
+	r = r.WithContext(withLogger(r.Context(), slog.String("session_id", session.ID)))
+	completePresignedUpload(w, r, session)
+}
+
+// getPresignedDownload returns a short-lived URL to download an upload from
+// the bucket. Objects encrypted client-side can only be read through the
+// gateway; compressed objects are served with their Content-Encoding.
+func getPresignedDownload(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx := r.Context()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+
+	objName := fmt.Sprintf("%s/%s", objDir, segments[3])
+	ctx = withLogger(ctx, slog.String("directory", objDir), slog.String("key", objName))
+
+	if deleted, err := uploadDeleted(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	} else if deleted {
+		util.NotFound(&w, "object_deleted")
+		return
+	}
+
+	objStore, objKey, ref, err := resolveUpload(ctx, objName)
+	if err != nil {
+		logger(ctx).Error("key_mapping_error", slog.Any("error", err))
+		util.InternalServerError(&w, "key_mapping_error")
+		return
+	}
+	store, ok := objStore.(storage.PresignStore)
+	if !ok {
+		util.NotImplemented(&w, "presign_not_supported")
+		return
+	}
+
+	objInfo, err := store.Stat(ctx, objKey)
+	if err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.NotFound(&w, "get_object_error")
+		return
+	}
+	objInfo = referencedInfo(objInfo, ref)
+	if envelope.IsEncrypted(objInfo.Metadata) {
+		util.Conflict(&w, "object_encrypted")
+		return
+	}
+
+	response := url.Values{}
+	response.Set("response-content-type", objInfo.ContentType)
+	response.Set("response-content-disposition", contentDisposition(r, objInfo))
+	if encoding := objInfo.Metadata[metaEncoding]; encoding != "" {
+		response.Set("response-content-encoding", encoding)
+	}
+	presigned, err := store.PresignGet(ctx, objKey, config.App.PresignExpiry, response)
+	if errors.Is(err, storage.ErrPresignNotSupported) {
+		util.NotImplemented(&w, "presign_not_supported")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("presign_error", slog.Any("error", err))
+		util.InternalServerError(&w, "presign_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(presigned)
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/util"
+)
+
+// DirectoryReport is one directory of a job report with its open failures
+type DirectoryReport struct {
+	DirectoryRecord
+	Verification string               `json:"verification"`
+	Failures     []FailedObjectRecord `json:"failures"`
+}
+
+// JobReport summarises what a migration job moved
+type JobReport struct {
+	Job         JobRecord         `json:"job"`
+	Directories []DirectoryReport `json:"directories"`
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": reportTime,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Migration report - job {{.Job.ID}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>Migration report - job {{.Job.ID}}</h1>
+<p>Kind: {{.Job.Kind}}, direction: {{.Job.Direction}}, status: {{.Job.Status}}, started: {{time .Job.StartedAt}}, completed: {{time .Job.CompletedAt}}</p>
+<table>
+<tr><th>Directory</th><th>Status</th><th>Verification</th><th>Started</th><th>Completed</th><th>Total files</th><th>Migrated files</th><th>Failed files</th><th>Bytes</th></tr>
+{{- range .Directories}}
+<tr><td>{{.Did}}</td><td>{{.Status}}</td><td>{{.Verification}}</td><td>{{time .StartedAt}}</td><td>{{time .CompletedAt}}</td><td>{{.Totalfiles}}</td><td>{{.MigratedFiles}}</td><td>{{.FailedFiles}}</td><td>{{.Bytes}}</td></tr>
+{{- end}}
+</table>
+{{- range .Directories}}{{if .Failures}}
+<h2>Failures in {{.Did}}</h2>
+<table>
+<tr><th>Key</th><th>Error code</th><th>Reason</th><th>Attempts</th><th>Last failed</th></tr>
+{{- range .Failures}}
+<tr><td>{{.ObjectKey}}</td><td>{{.ErrorCode}}</td><td>{{.ErrorMessage}}</td><td>{{.Attempts}}</td><td>{{time .UpdatedAt}}</td></tr>
+{{- end}}
+</table>
+{{- end}}{{end}}
+</body>
+</html>
+`))
+
+func reportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// verificationStatus summarises whether every object in a directory was
+// copied and verified against the source
+func verificationStatus(dir DirectoryRecord, failures []FailedObjectRecord) string {
+	for _, f := range failures {
+		if f.ErrorCode == "VerificationFailed" {
+			return "verification_failed"
+		}
+	}
+	completed := dir.Status == "completed" || dir.Status == statusPrefix(directionReverse)+"completed"
+	if completed && dir.FailedFiles == 0 && dir.MigratedFiles == dir.Totalfiles {
+		return "verified"
+	}
+	return "incomplete"
+}
+
+// buildJobReport collects the directories and failures of a job. A non-empty
+// code limits the listed failures, e.g. to RetentionNotPreserved, without
+// changing the verification status.
+func buildJobReport(id int64, code string) (JobReport, error) {
+	job, err := SelectJob(id)
+	if err != nil {
+		return JobReport{}, err
+	}
+	directories, err := SelectJobDirectories(id)
+	if err != nil {
+		return JobReport{}, err
+	}
+	failed, err := SelectJobFailedObjects(id)
+	if err != nil {
+		return JobReport{}, err
+	}
+
+	failures := make(map[string][]FailedObjectRecord)
+	for _, f := range failed {
+		failures[f.Did] = append(failures[f.Did], f)
+	}
+
+	report := JobReport{Job: job, Directories: make([]DirectoryReport, 0, len(directories))}
+	for _, dir := range directories {
+		listed := []FailedObjectRecord{}
+		for _, f := range failures[dir.Did] {
+			if code == "" || f.ErrorCode == code {
+				listed = append(listed, f)
+			}
+		}
+		report.Directories = append(report.Directories, DirectoryReport{
+			DirectoryRecord: dir,
+			Verification:    verificationStatus(dir, failures[dir.Did]),
+			Failures:        listed,
+		})
+	}
+	return report, nil
+}
+
+func writeCSVReport(w http.ResponseWriter, report JobReport) error {
+	writer := csv.NewWriter(w)
+	header := []string{"did", "status", "verification", "started_at", "completed_at",
+		"total_files", "migrated_files", "failed_files", "bytes",
+		"failed_key", "error_code", "error_message"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, dir := range report.Directories {
+		row := []string{dir.Did, dir.Status, dir.Verification,
+			reportTime(dir.StartedAt), reportTime(dir.CompletedAt),
+			strconv.FormatInt(dir.Totalfiles, 10), strconv.FormatInt(dir.MigratedFiles, 10),
+			strconv.FormatInt(dir.FailedFiles, 10), strconv.FormatInt(dir.Bytes, 10)}
+		if len(dir.Failures) == 0 {
+			if err := writer.Write(append(row, "", "", "")); err != nil {
+				return err
+			}
+			continue
+		}
+		// One row per failure so the file can be filtered in a spreadsheet
+		for _, f := range dir.Failures {
+			if err := writer.Write(append(row[:9:9], f.ObjectKey, f.ErrorCode, f.ErrorMessage)); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func getJobReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	id, err := strconv.ParseInt(segments[1], 10, 64)
+	if err != nil {
+		util.BadRequest(&w, "invalid_job_id")
+		return
+	}
+	ctx = withLogger(ctx, slog.Int64("job_id", id))
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if !util.Contains([]string{"json", "csv", "html"}, format) {
+		util.BadRequest(&w, "invalid_report_format")
+		return
+	}
+
+	report, err := buildJobReport(id, r.URL.Query().Get("code"))
+	if errors.Is(err, sql.ErrNoRows) {
+		util.NotFound(&w, "job_not_found")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("report_build_error", slog.Any("error", err))
+		util.InternalServerError(&w, "report_build_error")
+		return
+	}
+
+	filename := fmt.Sprintf("job-%d-report.%s", id, format)
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.WriteHeader(http.StatusOK)
+		err = writeCSVReport(w, report)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = reportTemplate.Execute(w, report)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(report)
+	}
+	if err != nil {
+		logger(ctx).Error("report_write_error", slog.Any("error", err))
+	}
+}
+
+// Jobs API
+func Jobs(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if !(len(segments) == 3 && segments[0] == "jobs" && segments[2] == "report") {
+		util.NotFound(&w, "path_not_found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getJobReport(w, r)
+	default:
+		util.MethodNotAllowed(&w, "method_not_allowed")
+	}
+}
@@ -1,49 +1,181 @@
 package app
 
 import (
-	"log"
+	"database/sql"
+	"errors"
+	"time"
 
 	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
 )
 
 func SelectDirectories() ([]DirectoryRecord, error) {
 	w := make([]DirectoryRecord, 0)
 	statement := `
-	select id, did, total_files, status, started_at, completed_at 
-	from roles where status='pending'`
+	select id, did, coalesce(total_files, 0), migrated_files, failed_files, bytes,
+		status, started_at, completed_at
+	from directory where status='pending'`
 	rows, err := config.DB.Query(statement)
 	if err != nil {
-		log.Println("Database Select Error:", err.Error())
+		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		r := DirectoryRecord{}
-		err = rows.Scan(&r.ID, &r.Did, &r.Totalfiles, &r.StartedAt, &r.CompletedAt, &r.Status)
+		r, err := scanDirectory(rows)
 		if err != nil {
 			return nil, err
 		}
 		w = append(w, r)
 	}
-	return w, err
+	return w, rows.Err()
 }
 
-func MarkDirectoryAsStarted(dir DirectoryRecord) error {
+func scanDirectory(rows *sql.Rows) (DirectoryRecord, error) {
+	r := DirectoryRecord{}
+	var startedAt, completedAt sql.NullTime
+	err := rows.Scan(&r.ID, &r.Did, &r.Totalfiles, &r.MigratedFiles, &r.FailedFiles, &r.Bytes,
+		&r.Status, &startedAt, &completedAt)
+	r.StartedAt = startedAt.Time
+	r.CompletedAt = completedAt.Time
+	return r, err
+}
+
+func MarkDirectoryAsStarted(dir DirectoryRecord, jobID int64) error {
 	_, err := config.DB.Exec(`
 		UPDATE directory
-		SET status = 'in_progress', started_at = now()
+		SET status = 'in_progress', started_at = now(), job_id = $2
 		WHERE did = $1
-	`, dir.Did)
+	`, dir.Did, jobID)
 	return err
 }
 
-func MarkDirectoryAsCompleted(did string) error {
+// MarkDirectoryAsFinished stores the worker counts and the status they imply
+func MarkDirectoryAsFinished(did string, stats DirectoryStats) error {
+	return markDirectoryFinished(did, stats.Status(), stats)
+}
+
+// StartDirectoryRollback records that a job rolls a directory back. The
+// directory row keeps the job and counts of its forward run.
+func StartDirectoryRollback(did string, jobID int64) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO directory_rollback (job_id, did)
+		VALUES ($1, $2)
+		ON CONFLICT (job_id, did) DO UPDATE
+		SET status = 'rollback_in_progress', started_at = now(), completed_at = null
+	`, jobID, did)
+	return err
+}
+
+// MarkDirectoryAsRolledBack stores the counts of a rollback under the
+// rollback_ status prefix. A directory rolled back without errors is set to
+// pending, so the next forward migration copies it again; after a partial
+// rollback it is re-queued once a retry has recovered the failures.
+func MarkDirectoryAsRolledBack(did string, jobID int64, stats DirectoryStats) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE directory_rollback
+		SET status = $3, completed_at = now(),
+			total_files = $4, migrated_files = $5, failed_files = $6, bytes = $7
+		WHERE job_id = $1 AND did = $2
+	`, jobID, did, statusPrefix(directionReverse)+stats.Status(),
+		stats.TotalFiles, stats.MigratedFiles, stats.FailedFiles, stats.Bytes)
+	if err != nil {
+		return err
+	}
+	if stats.Status() == "completed" {
+		if _, err = tx.Exec(`UPDATE directory SET status = 'pending' WHERE did = $1`, did); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func markDirectoryFinished(did, status string, stats DirectoryStats) error {
 	_, err := config.DB.Exec(`
 		UPDATE directory
-		SET status = 'completed', completed_at = now()
+		SET status = $2, completed_at = now(),
+			total_files = $3, migrated_files = $4, failed_files = $5, bytes = $6
 		WHERE did = $1
-	`, did)
+	`, did, status, stats.TotalFiles, stats.MigratedFiles, stats.FailedFiles, stats.Bytes)
 	return err
 }
 
+// MarkDirectoryAsRetried adds the files recovered by a retry and recomputes
+// the directory status from the failures that remain. Reverse failures count
+// towards the last rollback of the directory, which re-queues it for the
+// forward migration once none remain.
+func MarkDirectoryAsRetried(did, direction string, migrated, bytes int64, remaining int) error {
+	if direction != directionReverse {
+		_, err := config.DB.Exec(`
+			UPDATE directory
+			SET migrated_files = migrated_files + $2,
+				bytes = bytes + $3,
+				failed_files = $4,
+				status = $5 || case
+					when $4 = 0 then 'completed'
+					when migrated_files + $2 = 0 then 'failed'
+					else 'completed_with_errors'
+				end,
+				completed_at = now()
+			WHERE did = $1
+		`, did, migrated, bytes, remaining, statusPrefix(direction))
+		return err
+	}
+
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE directory_rollback
+		SET migrated_files = migrated_files + $2,
+			bytes = bytes + $3,
+			failed_files = $4,
+			status = $5 || case
+				when $4 = 0 then 'completed'
+				when migrated_files + $2 = 0 then 'failed'
+				else 'completed_with_errors'
+			end,
+			completed_at = now()
+		WHERE id = (SELECT max(id) FROM directory_rollback WHERE did = $1)
+	`, did, migrated, bytes, remaining, statusPrefix(direction))
+	if err != nil {
+		return err
+	}
+	if remaining == 0 {
+		if _, err = tx.Exec(`UPDATE directory SET status = 'pending' WHERE did = $1`, did); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SelectDirectory returns one directory, or sql.ErrNoRows when it is unknown
+func SelectDirectory(did string) (DirectoryRecord, error) {
+	rows, err := config.DB.Query(`
+	select id, did, coalesce(total_files, 0), migrated_files, failed_files, bytes,
+		status, started_at, completed_at
+	from directory where did = $1`, did)
+	if err != nil {
+		return DirectoryRecord{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return DirectoryRecord{}, err
+		}
+		return DirectoryRecord{}, sql.ErrNoRows
+	}
+	return scanDirectory(rows)
+}
+
 func DirectoryMigrated(did string) bool {
 
 	// Prepare the SQL statement to get directory status
@@ -60,3 +192,811 @@ func DirectoryMigrated(did string) bool {
 	}
 	return status == "completed"
 }
+
+func RecordFailedObject(jobID int64, direction, did, objectKey, code, message string) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO failed_object (job_id, did, object_key, error_code, error_message, direction)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (object_key, direction) DO UPDATE
+		SET job_id = excluded.job_id,
+			error_code = excluded.error_code,
+			error_message = excluded.error_message,
+			attempts = failed_object.attempts + 1,
+			status = 'failed',
+			updated_at = now()
+	`, jobID, did, objectKey, code, message, direction)
+	return err
+}
+
+func ResolveFailedObject(objectKey, direction string) error {
+	_, err := config.DB.Exec(`
+		UPDATE failed_object
+		SET status = 'resolved', updated_at = now()
+		WHERE object_key = $1 AND direction = $2
+	`, objectKey, direction)
+	return err
+}
+
+// SelectFailedObjects returns unresolved failures, optionally narrowed to a
+// directory, an error code and a minimum failure time.
+func SelectFailedObjects(did, code string, since time.Time) ([]FailedObjectRecord, error) {
+	w := make([]FailedObjectRecord, 0)
+	statement := `
+	select id, did, object_key, error_code, error_message, attempts, status, direction, failed_at, updated_at
+	from failed_object
+	where status = 'failed'
+	and ($1 = '' or did = $1)
+	and ($2 = '' or error_code = $2)
+	and updated_at >= $3
+	order by did, object_key`
+	rows, err := config.DB.Query(statement, did, code, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := FailedObjectRecord{}
+		err = rows.Scan(&r.ID, &r.Did, &r.ObjectKey, &r.ErrorCode, &r.ErrorMessage,
+			&r.Attempts, &r.Status, &r.Direction, &r.FailedAt, &r.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, r)
+	}
+	return w, rows.Err()
+}
+
+// CountFailedObjects returns the number of unresolved failures in a directory
+// in one direction
+func CountFailedObjects(did, direction string) (int, error) {
+	var count int
+	err := config.DB.QueryRow(`
+		SELECT count(*)
+		FROM failed_object
+		WHERE did = $1 AND direction = $2 AND status = 'failed'
+	`, did, direction).Scan(&count)
+	return count, err
+}
+
+func CreateJob(kind, direction string) (int64, error) {
+	var id int64
+	err := config.DB.QueryRow(`
+		INSERT INTO job (kind, direction)
+		VALUES ($1, $2)
+		RETURNING id
+	`, kind, direction).Scan(&id)
+	return id, err
+}
+
+func MarkJobAsFinished(id int64, status string) error {
+	_, err := config.DB.Exec(`
+		UPDATE job
+		SET status = $2, completed_at = now()
+		WHERE id = $1
+	`, id, status)
+	return err
+}
+
+func SelectJob(id int64) (JobRecord, error) {
+	r := JobRecord{}
+	var completedAt sql.NullTime
+	err := config.DB.QueryRow(`
+		SELECT id, kind, direction, status, started_at, completed_at
+		FROM job
+		WHERE id = $1
+	`, id).Scan(&r.ID, &r.Kind, &r.Direction, &r.Status, &r.StartedAt, &completedAt)
+	r.CompletedAt = completedAt.Time
+	return r, err
+}
+
+// SelectJobDirectories returns the directories last migrated or rolled back
+// by a job
+func SelectJobDirectories(jobID int64) ([]DirectoryRecord, error) {
+	w := make([]DirectoryRecord, 0)
+	statement := `
+	select id, did, coalesce(total_files, 0), migrated_files, failed_files, bytes,
+		status, started_at, completed_at
+	from directory where job_id = $1
+	union all
+	select id, did, total_files, migrated_files, failed_files, bytes,
+		status, started_at, completed_at
+	from directory_rollback where job_id = $1
+	order by started_at, did`
+	rows, err := config.DB.Query(statement, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanDirectory(rows)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, r)
+	}
+	return w, rows.Err()
+}
+
+// SelectJobFailedObjects returns the unresolved failures in the directories
+// last migrated or rolled back by a job
+func SelectJobFailedObjects(jobID int64) ([]FailedObjectRecord, error) {
+	w := make([]FailedObjectRecord, 0)
+	statement := `
+	select f.id, f.did, f.object_key, f.error_code, f.error_message, f.attempts, f.status, f.direction, f.failed_at, f.updated_at
+	from failed_object f
+	where f.status = 'failed' and (
+		(f.direction = 'forward' and f.did in (select did from directory where job_id = $1)) or
+		(f.direction = 'reverse' and f.did in (select did from directory_rollback where job_id = $1)))
+	order by f.did, f.object_key`
+	rows, err := config.DB.Query(statement, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := FailedObjectRecord{}
+		err = rows.Scan(&r.ID, &r.Did, &r.ObjectKey, &r.ErrorCode, &r.ErrorMessage,
+			&r.Attempts, &r.Status, &r.Direction, &r.FailedAt, &r.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, r)
+	}
+	return w, rows.Err()
+}
+
+func RecordKeyMapping(sourceKey, targetKey string) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO key_mapping (source_key, target_key)
+		VALUES ($1, $2)
+		ON CONFLICT (source_key) DO UPDATE
+		SET target_key = excluded.target_key, created_at = now()
+	`, sourceKey, targetKey)
+	return err
+}
+
+// SelectKeyMapping returns the target key a source key was rewritten to
+func SelectKeyMapping(sourceKey string) (string, error) {
+	var targetKey string
+	err := config.DB.QueryRow(`
+		SELECT target_key
+		FROM key_mapping
+		WHERE source_key = $1
+	`, sourceKey).Scan(&targetKey)
+	return targetKey, err
+}
+
+// SelectDirectoryKeyMappings returns the keys of a directory that were
+// migrated under another key or moved, wherever their target key lives
+func SelectDirectoryKeyMappings(did string) ([]KeyMapping, error) {
+	w := make([]KeyMapping, 0)
+	rows, err := config.DB.Query(`
+		SELECT source_key, target_key
+		FROM key_mapping
+		WHERE source_key LIKE $1 || '/%'
+		ORDER BY source_key
+	`, did)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mapping KeyMapping
+		if err = rows.Scan(&mapping.SourceKey, &mapping.TargetKey); err != nil {
+			return nil, err
+		}
+		w = append(w, mapping)
+	}
+	return w, rows.Err()
+}
+
+// RecordVersionMapping stores which target version a source version was
+// replayed as
+func RecordVersionMapping(jobID int64, sourceKey, sourceVersionID, targetKey, targetVersionID string, deleteMarker bool) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO object_version (source_key, source_version_id, target_key, target_version_id, delete_marker, job_id)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source_key, source_version_id) DO UPDATE
+		SET target_key = excluded.target_key, target_version_id = excluded.target_version_id,
+			delete_marker = excluded.delete_marker, job_id = excluded.job_id, created_at = now()
+	`, sourceKey, sourceVersionID, targetKey, targetVersionID, deleteMarker, jobID)
+	return err
+}
+
+// SelectVersionMapping returns the target key a source version was replayed
+// to, or sql.ErrNoRows when it has not been migrated yet
+func SelectVersionMapping(sourceKey, sourceVersionID string) (string, error) {
+	var targetKey string
+	err := config.DB.QueryRow(`
+		SELECT target_key
+		FROM object_version
+		WHERE source_key = $1 AND source_version_id = $2
+	`, sourceKey, sourceVersionID).Scan(&targetKey)
+	return targetKey, err
+}
+
+// ScheduleDeletion journals a verified source object for deletion once the
+// grace delay has passed. Scheduling again resets the entry to pending.
+func ScheduleDeletion(jobID int64, did, sourceKey, sourceETag, targetKey string, grace time.Duration) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO deletion_journal (job_id, did, source_key, source_etag, target_key, delete_after)
+		VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 second')
+		ON CONFLICT (source_key) DO UPDATE
+		SET job_id = excluded.job_id, did = excluded.did, source_etag = excluded.source_etag,
+			target_key = excluded.target_key, delete_after = excluded.delete_after,
+			status = 'pending', message = '', deleted_at = null
+	`, jobID, did, sourceKey, sourceETag, targetKey, grace.Seconds())
+	return err
+}
+
+// SelectDueDeletions returns up to limit pending deletions whose grace delay
+// has passed, oldest first. Only directories that completed without errors
+// are due.
+func SelectDueDeletions(limit int) ([]DeletionRecord, error) {
+	rows, err := config.DB.Query(`
+		SELECT j.id, j.job_id, j.did, j.source_key, j.source_etag, j.target_key, j.status, j.message, j.delete_after
+		FROM deletion_journal j
+		JOIN directory d ON d.did = j.did
+		WHERE j.status = 'pending' AND j.delete_after <= now() AND d.status = 'completed'
+		ORDER BY j.delete_after
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deletions []DeletionRecord
+	for rows.Next() {
+		d := DeletionRecord{}
+		var jobID sql.NullInt64
+		err := rows.Scan(&d.ID, &jobID, &d.Did, &d.SourceKey, &d.SourceETag, &d.TargetKey,
+			&d.Status, &d.Message, &d.DeleteAfter)
+		if err != nil {
+			return nil, err
+		}
+		d.JobID = jobID.Int64
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
+
+// MarkDeletion records the outcome of a journaled deletion
+func MarkDeletion(id int64, status, message string) error {
+	_, err := config.DB.Exec(`
+		UPDATE deletion_journal
+		SET status = $2, message = $3,
+			deleted_at = case when $2 = 'deleted' then now() else deleted_at end
+		WHERE id = $1
+	`, id, status, message)
+	return err
+}
+
+// CountJobDeletions returns how many source objects a job has deleted
+func CountJobDeletions(jobID int64) (int, error) {
+	var count int
+	err := config.DB.QueryRow(`
+		SELECT count(*)
+		FROM deletion_journal
+		WHERE job_id = $1 AND status = 'deleted'
+	`, jobID).Scan(&count)
+	return count, err
+}
+
+// HoldDeletions sets the pending deletions of a job aside with a reason.
+// Migrating the objects again schedules them anew.
+func HoldDeletions(jobID int64, message string) (int64, error) {
+	result, err := config.DB.Exec(`
+		UPDATE deletion_journal
+		SET status = 'held', message = $2
+		WHERE job_id = $1 AND status = 'pending'
+	`, jobID, message)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SkipDirectoryDeletions drops the pending deletions a job scheduled for a
+// directory that did not complete
+func SkipDirectoryDeletions(jobID int64, did, message string) (int64, error) {
+	result, err := config.DB.Exec(`
+		UPDATE deletion_journal
+		SET status = 'skipped', message = $3
+		WHERE job_id = $1 AND did = $2 AND status = 'pending'
+	`, jobID, did, message)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SelectSourceKey returns the source key that was rewritten to a target key,
+// or sql.ErrNoRows when the key was migrated unchanged
+func SelectSourceKey(targetKey string) (string, error) {
+	var sourceKey string
+	err := config.DB.QueryRow(`
+		SELECT source_key
+		FROM key_mapping
+		WHERE target_key = $1
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, targetKey).Scan(&sourceKey)
+	return sourceKey, err
+}
+
+// SelectBlob returns where the content with the given hash is stored
+func SelectBlob(hash string) (string, error) {
+	var objectKey string
+	err := config.DB.QueryRow(`
+		SELECT object_key
+		FROM blob
+		WHERE hash = $1
+	`, hash).Scan(&objectKey)
+	return objectKey, err
+}
+
+// SelectBlobByKey returns the hash of the content stored at a physical key
+func SelectBlobByKey(objectKey string) (string, error) {
+	var hash string
+	err := config.DB.QueryRow(`
+		SELECT hash
+		FROM blob
+		WHERE object_key = $1
+	`, objectKey).Scan(&hash)
+	return hash, err
+}
+
+// RegisterBlob records content stored at objectKey and returns the key the
+// content is registered under, which differs when another writer won
+func RegisterBlob(hash, objectKey string, size int64) (string, error) {
+	_, err := config.DB.Exec(`
+		INSERT INTO blob (hash, object_key, size)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (hash) DO NOTHING
+	`, hash, objectKey, size)
+	if err != nil {
+		return "", err
+	}
+	return SelectBlob(hash)
+}
+
+// SelectBlobReference returns the physical key behind a deduplicated key,
+// with the name and URL it was uploaded under
+func SelectBlobReference(objectKey string) (BlobReference, error) {
+	ref := BlobReference{ObjectKey: objectKey}
+	err := config.DB.QueryRow(`
+		SELECT b.object_key, r.name, r.url
+		FROM blob_ref r
+		JOIN blob b ON b.hash = r.hash
+		WHERE r.object_key = $1
+	`, objectKey).Scan(&ref.BlobKey, &ref.Name, &ref.URL)
+	return ref, err
+}
+
+// AddBlobReference points objectKey at the content with the given hash,
+// keeping the name and URL it was uploaded under. When the key referenced
+// other content before, that reference is released and the physical key of
+// content left without references is returned.
+func AddBlobReference(did, objectKey, hash, name, url string) (string, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow(`
+		SELECT hash
+		FROM blob_ref
+		WHERE object_key = $1
+		FOR UPDATE
+	`, objectKey).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if previous == hash {
+		_, err = tx.Exec(`
+			UPDATE blob_ref
+			SET name = $2, url = $3
+			WHERE object_key = $1
+		`, objectKey, name, url)
+		if err != nil {
+			return "", err
+		}
+		return "", tx.Commit()
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO blob_ref (object_key, did, hash, name, url)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (object_key) DO UPDATE
+		SET did = excluded.did, hash = excluded.hash, name = excluded.name,
+			url = excluded.url, created_at = now()
+	`, objectKey, did, hash, name, url)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		UPDATE blob
+		SET ref_count = ref_count + 1
+		WHERE hash = $1
+	`, hash)
+	if err != nil {
+		return "", err
+	}
+
+	var orphan string
+	if previous != "" {
+		if orphan, err = releaseBlob(tx, previous); err != nil {
+			return "", err
+		}
+	}
+	return orphan, tx.Commit()
+}
+
+// ReleaseBlobReference removes a deduplicated key and returns the physical
+// key of the content when no references to it remain
+func ReleaseBlobReference(objectKey string) (string, error) {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.QueryRow(`
+		DELETE FROM blob_ref
+		WHERE object_key = $1
+		RETURNING hash
+	`, objectKey).Scan(&hash)
+	if err != nil {
+		return "", err
+	}
+
+	orphan, err := releaseBlob(tx, hash)
+	if err != nil {
+		return "", err
+	}
+	return orphan, tx.Commit()
+}
+
+// releaseBlob drops one reference and deletes the blob row when it was the
+// last, returning the physical key that may now be removed
+func releaseBlob(tx *sql.Tx, hash string) (string, error) {
+	var refCount int
+	var objectKey string
+	err := tx.QueryRow(`
+		UPDATE blob
+		SET ref_count = ref_count - 1
+		WHERE hash = $1
+		RETURNING ref_count, object_key
+	`, hash).Scan(&refCount, &objectKey)
+	if err != nil {
+		return "", err
+	}
+	if refCount > 0 {
+		return "", nil
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM blob
+		WHERE hash = $1
+	`, hash)
+	if err != nil {
+		return "", err
+	}
+	return objectKey, nil
+}
+
+// SelectDirectoryBlobReferences returns the keys a directory references and
+// the physical keys of their content, in byte order like a bucket listing
+func SelectDirectoryBlobReferences(did string) ([]BlobReference, error) {
+	w := make([]BlobReference, 0)
+	rows, err := config.DB.Query(`
+		SELECT r.object_key, b.object_key, r.name, r.url
+		FROM blob_ref r
+		JOIN blob b ON b.hash = r.hash
+		WHERE r.did = $1
+		ORDER BY r.object_key COLLATE "C"
+	`, did)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ref BlobReference
+		if err = rows.Scan(&ref.ObjectKey, &ref.BlobKey, &ref.Name, &ref.URL); err != nil {
+			return nil, err
+		}
+		w = append(w, ref)
+	}
+	return w, rows.Err()
+}
+
+// SelectDirectoryReferencesSince returns the keys a directory references in
+// dedup mode that were added after since
+func SelectDirectoryReferencesSince(did string, since time.Time) ([]string, error) {
+	w := make([]string, 0)
+	rows, err := config.DB.Query(`
+		SELECT object_key
+		FROM blob_ref
+		WHERE did = $1 AND created_at > $2
+		ORDER BY object_key
+	`, did, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		w = append(w, key)
+	}
+	return w, rows.Err()
+}
+
+func CreateUploadSession(s UploadSession) error {
+	_, err := config.DB.Exec(`
+		INSERT INTO upload_session (id, kind, did, tenant, file_name, content_type, object_key, upload_id, length, hash_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, s.ID, s.Kind, s.Did, s.Tenant, s.FileName, s.ContentType, s.ObjectKey, s.UploadID, s.Length, s.HashState)
+	return err
+}
+
+// SelectUploadSession returns a session, or sql.ErrNoRows when it is unknown
+func SelectUploadSession(id string) (UploadSession, error) {
+	s := UploadSession{}
+	err := config.DB.QueryRow(`
+		SELECT id, kind, did, tenant, file_name, content_type, object_key, upload_id,
+			length, "offset", hash_state, status, created_at, updated_at
+		FROM upload_session
+		WHERE id = $1
+	`, id).Scan(&s.ID, &s.Kind, &s.Did, &s.Tenant, &s.FileName, &s.ContentType, &s.ObjectKey, &s.UploadID,
+		&s.Length, &s.Offset, &s.HashState, &s.Status, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+// errOffsetConflict is returned when another chunk moved the session on
+var errOffsetConflict = errors.New("upload offset changed")
+
+// ReserveUploadPart returns a part number no other chunk of the session
+// uses, failing with errOffsetConflict when the session is no longer at
+// offset. Numbers of chunks that lose the race are skipped, which S3 allows.
+func ReserveUploadPart(id string, offset int64) (int, error) {
+	var number int
+	err := config.DB.QueryRow(`
+		UPDATE upload_session
+		SET next_part = next_part + 1
+		WHERE id = $1 AND "offset" = $2 AND status = 'open'
+		RETURNING next_part
+	`, id, offset).Scan(&number)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errOffsetConflict
+	}
+	return number, err
+}
+
+// AdvanceUploadSession records an uploaded part and moves the offset from
+// offset to offset+part.Size, failing with errOffsetConflict when the session
+// is no longer at offset
+func AdvanceUploadSession(id string, offset int64, part storage.Part, hashState []byte) error {
+	tx, err := config.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE upload_session
+		SET "offset" = $3, hash_state = $4, updated_at = now()
+		WHERE id = $1 AND "offset" = $2 AND status = 'open'
+	`, id, offset, offset+part.Size, hashState)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errOffsetConflict
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO upload_part (session_id, part_number, etag, size)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, part_number) DO UPDATE
+		SET etag = excluded.etag, size = excluded.size
+	`, id, part.Number, part.ETag, part.Size)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SelectUploadParts returns the parts of a session in order
+func SelectUploadParts(id string) ([]storage.Part, error) {
+	rows, err := config.DB.Query(`
+		SELECT part_number, etag, size
+		FROM upload_part
+		WHERE session_id = $1
+		ORDER BY part_number
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []storage.Part
+	for rows.Next() {
+		var part storage.Part
+		if err = rows.Scan(&part.Number, &part.ETag, &part.Size); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
+
+// MarkUploadSession sets the status of a session: completed, aborted or
+// rejected
+func MarkUploadSession(id, status string) error {
+	_, err := config.DB.Exec(`
+		UPDATE upload_session
+		SET status = $2, updated_at = now()
+		WHERE id = $1
+	`, id, status)
+	return err
+}
+
+// SelectIdleUploadSessions returns up to limit open sessions last updated
+// before idleSince, oldest first
+func SelectIdleUploadSessions(idleSince time.Time, limit int) ([]UploadSession, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, kind, did, tenant, file_name, content_type, object_key, upload_id,
+			length, "offset", hash_state, status, created_at, updated_at
+		FROM upload_session
+		WHERE status = 'open' AND updated_at < $1
+		ORDER BY updated_at
+		LIMIT $2
+	`, idleSince, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []UploadSession
+	for rows.Next() {
+		s := UploadSession{}
+		err = rows.Scan(&s.ID, &s.Kind, &s.Did, &s.Tenant, &s.FileName, &s.ContentType, &s.ObjectKey, &s.UploadID,
+			&s.Length, &s.Offset, &s.HashState, &s.Status, &s.CreatedAt, &s.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// errAlreadyDeleted is returned when an upload has a pending deletion
+var errAlreadyDeleted = errors.New("upload already deleted")
+
+// DeleteUpload records the deletion of an upload, to be purged after
+// purgeAfter
+func DeleteUpload(did, objectKey string, purgeAfter time.Time) (UploadDeletion, error) {
+	d := UploadDeletion{Did: did, ObjectKey: objectKey, Status: "deleted", PurgeAfter: purgeAfter}
+	err := config.DB.QueryRow(`
+		INSERT INTO upload_deletion (did, object_key, purge_after)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (object_key) WHERE status = 'deleted' DO NOTHING
+		RETURNING id, deleted_at
+	`, did, objectKey, purgeAfter).Scan(&d.ID, &d.DeletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, errAlreadyDeleted
+	}
+	return d, err
+}
+
+// SelectUploadDeletion returns the pending deletion of an upload, or
+// sql.ErrNoRows when it is not deleted
+func SelectUploadDeletion(objectKey string) (UploadDeletion, error) {
+	d := UploadDeletion{}
+	err := config.DB.QueryRow(`
+		SELECT id, did, object_key, status, message, purge_after, deleted_at
+		FROM upload_deletion
+		WHERE object_key = $1 AND status = 'deleted'
+	`, objectKey).Scan(&d.ID, &d.Did, &d.ObjectKey, &d.Status, &d.Message, &d.PurgeAfter, &d.DeletedAt)
+	return d, err
+}
+
+// RestoreUpload cancels the pending deletion of an upload while the restore
+// window is open, and returns sql.ErrNoRows otherwise
+func RestoreUpload(objectKey string) error {
+	result, err := config.DB.Exec(`
+		UPDATE upload_deletion
+		SET status = 'restored', restored_at = now()
+		WHERE object_key = $1 AND status = 'deleted' AND purge_after > now()
+	`, objectKey)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ReplaceUploadDeletion cancels the pending deletion of an upload stored
+// again under the same name
+func ReplaceUploadDeletion(objectKey string) error {
+	_, err := config.DB.Exec(`
+		UPDATE upload_deletion
+		SET status = 'replaced'
+		WHERE object_key = $1 AND status = 'deleted'
+	`, objectKey)
+	return err
+}
+
+// SelectDuePurges returns up to limit deletions whose restore window closed
+func SelectDuePurges(limit int) ([]UploadDeletion, error) {
+	rows, err := config.DB.Query(`
+		SELECT id, did, object_key, status, message, purge_after, deleted_at
+		FROM upload_deletion
+		WHERE status = 'deleted' AND purge_after <= now()
+		ORDER BY purge_after
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deletions []UploadDeletion
+	for rows.Next() {
+		d := UploadDeletion{}
+		if err = rows.Scan(&d.ID, &d.Did, &d.ObjectKey, &d.Status, &d.Message, &d.PurgeAfter, &d.DeletedAt); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
+
+// MarkUploadPurged records the outcome of a purge: purged, or deleted with a
+// message to be tried again on the next sweep
+func MarkUploadPurged(id int64, status, message string) error {
+	_, err := config.DB.Exec(`
+		UPDATE upload_deletion
+		SET status = $2, message = $3,
+			purged_at = case when $2 = 'purged' then now() else purged_at end
+		WHERE id = $1
+	`, id, status, message)
+	return err
+}
+
+// SelectDeletedUploads returns the keys of a directory with a pending
+// deletion
+func SelectDeletedUploads(did string) ([]string, error) {
+	rows, err := config.DB.Query(`
+		SELECT object_key
+		FROM upload_deletion
+		WHERE did = $1 AND status = 'deleted'
+	`, did)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+)
+
+type retryFilter struct {
+	Did   string
+	Code  string
+	Since time.Time
+}
+
+// RetryFailedHandler re-runs the migration for recorded failures. The
+// selection can be narrowed with the did, code and since (RFC 3339) query
+// parameters.
+func RetryFailedHandler(w http.ResponseWriter, r *http.Request) {
+	if isRunning {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Migration is already running"))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := retryFilter{Did: query.Get("did"), Code: query.Get("code")}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid since, expected RFC 3339 time"))
+			return
+		}
+		filter.Since = t
+	}
+
+	failed, err := SelectFailedObjects(filter.Did, filter.Code, filter.Since)
+	if err != nil {
+		logger(r.Context()).Error("Select failed objects Error", slog.Any("error", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to select failed files"))
+		return
+	}
+	if len(failed) == 0 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("No failed files to retry"))
+		return
+	}
+
+	go runMigration("retry", directionForward, func(ctx context.Context) error {
+		if config.App.Versions {
+			if _, _, err := versionedStores(); err != nil {
+				return err
+			}
+		}
+		return retryFailedObjects(ctx, failed)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Retrying %d failed files", len(failed))))
+}
+
+// retryTarget is a directory and the direction its failures were recorded in
+type retryTarget struct {
+	did       string
+	direction string
+}
+
+func retryFailedObjects(ctx context.Context, failed []FailedObjectRecord) error {
+	directories := make(map[retryTarget]*DirectoryStats)
+	for _, object := range failed {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		target := retryTarget{did: object.Did, direction: object.Direction}
+		stats, ok := directories[target]
+		if !ok {
+			stats = &DirectoryStats{}
+			directories[target] = stats
+		}
+
+		objCtx := withLogger(ctx, slog.String("directory", object.Did), slog.String("key", object.ObjectKey))
+		start := time.Now()
+		if object.Direction == directionReverse {
+			// Failures of a rollback are retried as a rollback
+			objCtx = withDirection(objCtx, directionReverse)
+			size, err := withRetry(objCtx, func() (int64, error) {
+				return rollbackObject(objCtx, object.ObjectKey, "")
+			})
+			if err != nil {
+				logFailedFile(objCtx, object.Did, object.ObjectKey, err)
+				continue
+			}
+			if err = ResolveFailedObject(object.ObjectKey, object.Direction); err != nil {
+				logger(objCtx).Error("Failed to resolve failed file", slog.Any("error", err))
+				continue
+			}
+			stats.MigratedFiles++
+			stats.Bytes += size
+			markFileAsMigrated(objCtx, size, time.Since(start))
+			continue
+		}
+		if config.App.Versions {
+			// Versions replayed before the failure stay in the mapping
+			result, err := retryObjectVersions(objCtx, object.Did, object.ObjectKey)
+			stats.MigratedFiles += result.Replayed
+			stats.Bytes += result.Bytes
+			if err != nil {
+				logFailedFile(objCtx, object.Did, object.ObjectKey, err)
+				continue
+			}
+			if err = ResolveFailedObject(object.ObjectKey, object.Direction); err != nil {
+				logger(objCtx).Error("Failed to resolve failed file", slog.Any("error", err))
+			}
+			markFileAsMigrated(objCtx, result.Bytes, time.Since(start))
+			continue
+		}
+
+		size, err := migrateObjectWithRetry(objCtx, object.Did, object.ObjectKey)
+		if err != nil {
+			logFailedFile(objCtx, object.Did, object.ObjectKey, err)
+			continue
+		}
+		if err = ResolveFailedObject(object.ObjectKey, object.Direction); err != nil {
+			logger(objCtx).Error("Failed to resolve failed file", slog.Any("error", err))
+			continue
+		}
+		stats.MigratedFiles++
+		stats.Bytes += size
+		markFileAsMigrated(objCtx, size, time.Since(start))
+	}
+
+	// Directories with no outstanding failures are now complete
+	for target, stats := range directories {
+		dirCtx := withLogger(ctx, slog.String("directory", target.did))
+		remaining, err := CountFailedObjects(target.did, target.direction)
+		if err != nil {
+			logger(dirCtx).Error("Failed to count failed files", slog.Any("error", err))
+			continue
+		}
+		if remaining > 0 {
+			logger(dirCtx).Warn("Directory still has failed files", slog.Int("failed_files", remaining))
+		}
+		err = MarkDirectoryAsRetried(target.did, target.direction, stats.MigratedFiles, stats.Bytes, remaining)
+		if err != nil {
+			logger(dirCtx).Error("Failed to update directory status", slog.Any("error", err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// rewriteData is the input of template rewrite rules, e.g.
+// {{.Tenant}}/{{.Year}}/{{.Month}}/{{.Hash}}{{.Ext}}
+type rewriteData struct {
+	ctx  context.Context
+	info storage.ObjectInfo
+	hash string
+
+	Key          string
+	Dir          string
+	Base         string
+	Name         string
+	Ext          string
+	Tenant       string
+	ContentType  string
+	LastModified time.Time
+	Year         string
+	Month        string
+	Day          string
+	Metadata     map[string]string
+}
+
+// Hash returns the SHA-256 of the object
+func (d *rewriteData) Hash() (string, error) {
+	if d.hash != "" {
+		return d.hash, nil
+	}
+	hash, err := objectHash(d.ctx, d.info)
+	d.hash = hash
+	return hash, err
+}
+
+func newRewriteData(ctx context.Context, info storage.ObjectInfo) *rewriteData {
+	base := path.Base(info.Key)
+	ext := path.Ext(base)
+	modified := info.LastModified.UTC()
+	return &rewriteData{
+		ctx:          ctx,
+		info:         info,
+		Key:          info.Key,
+		Dir:          path.Dir(info.Key),
+		Base:         base,
+		Name:         strings.TrimSuffix(base, ext),
+		Ext:          ext,
+		Tenant:       strings.SplitN(info.Key, "/", 2)[0],
+		ContentType:  info.ContentType,
+		LastModified: modified,
+		Year:         modified.Format("2006"),
+		Month:        modified.Format("01"),
+		Day:          modified.Format("02"),
+		Metadata:     info.Metadata,
+	}
+}
+
+// rewriteKey applies the first matching rule in config.RewriteRules and
+// returns the key the object is stored under on the target
+func rewriteKey(ctx context.Context, info storage.ObjectInfo) (string, error) {
+	for i, rule := range config.RewriteRules {
+		switch rule.Type {
+		case "prefix":
+			if strings.HasPrefix(info.Key, rule.Match) {
+				return rule.Replace + strings.TrimPrefix(info.Key, rule.Match), nil
+			}
+		case "regex":
+			if rule.Pattern.MatchString(info.Key) {
+				return rule.Pattern.ReplaceAllString(info.Key, rule.Replace), nil
+			}
+		case "template":
+			if rule.Pattern != nil && !rule.Pattern.MatchString(info.Key) {
+				continue
+			}
+			var key strings.Builder
+			if err := rule.Tmpl.Execute(&key, newRewriteData(ctx, info)); err != nil {
+				return "", fmt.Errorf("rewrite rule %d: %w", i, err)
+			}
+			if key.Len() == 0 {
+				return "", fmt.Errorf("rewrite rule %d: empty key for %s", i, info.Key)
+			}
+			return key.String(), nil
+		}
+	}
+	return info.Key, nil
+}
+
+// resolveUpload returns where an upload key can be read: on the target under
+// its mapped key when it was migrated with a new name or moved, or under the
+// key holding its content when it was deduplicated, otherwise on the source,
+// or on the target when the source does not have it, as for uploads written
+// since the migration. The blob reference is returned for deduplicated keys,
+// their name and URL must be read from it rather than the stored content.
+func resolveUpload(ctx context.Context, objName string) (storage.ObjectStore, string, *BlobReference, error) {
+	key, mapped := objName, false
+	targetKey, err := SelectKeyMapping(objName)
+	if err == nil {
+		key, mapped = targetKey, true
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil, err
+	}
+
+	ref, err := SelectBlobReference(key)
+	if err == nil {
+		return config.TargetStore, ref.BlobKey, &ref, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil, err
+	}
+
+	if mapped {
+		return config.TargetStore, key, nil, nil
+	}
+	if _, err = config.SourceStore.Stat(ctx, objName); errors.Is(err, storage.ErrNotFound) {
+		return config.TargetStore, objName, nil, nil
+	}
+	return config.SourceStore, objName, nil, nil
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// loadRewriteRules loads rules the way the service does, from a JSON file
+// named by APP_REWRITE_RULES
+func loadRewriteRules(t *testing.T, rules string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APP_REWRITE_RULES", file)
+	config.RewriteRules = nil
+	config.InitializeRewrite()
+}
+
+func TestRewriteKey(t *testing.T) {
+	withAppConfig(t)
+	source, _ := newTestStores(t)
+	loadRewriteRules(t, `[
+		{"type": "prefix", "match": "legacy/", "replace": "archive/"},
+		{"type": "regex", "match": "^([^/]+)/thumbs/(.*)$", "replace": "$1/thumbnails/$2"},
+		{"type": "template", "match": "^photos/", "template": "{{.Tenant}}/{{.Year}}/{{.Month}}/{{.Day}}/{{.Hash}}{{.Ext}}"},
+		{"type": "template", "match": "^named/", "template": "{{.Dir}}/{{.Metadata.owner}}-{{.Name}}{{.Ext}}"},
+		{"type": "prefix", "match": "legacy/old/", "replace": "never/"}
+	]`)
+
+	content := "photo"
+	putObject(t, source, "photos/b.png", content, storage.PutOptions{})
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	// Dates are taken in UTC
+	modified := time.Date(2024, 3, 10, 1, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+
+	tests := []struct {
+		name    string
+		info    storage.ObjectInfo
+		want    string
+		wantErr bool
+	}{
+		{"prefix", storage.ObjectInfo{Key: "legacy/a.png"}, "archive/a.png", false},
+		{"first match wins", storage.ObjectInfo{Key: "legacy/old/a.png"}, "archive/old/a.png", false},
+		{"regex", storage.ObjectInfo{Key: "ns-01/thumbs/a.png"}, "ns-01/thumbnails/a.png", false},
+		{"template with the recorded hash", storage.ObjectInfo{
+			Key:          "photos/a.png",
+			LastModified: modified,
+			Metadata:     map[string]string{"hash": "abc"},
+		}, "photos/2024/03/09/abc.png", false},
+		{"template hashing the content", storage.ObjectInfo{
+			Key:          "photos/b.png",
+			LastModified: modified,
+			Metadata:     map[string]string{},
+		}, "photos/2024/03/09/" + sum + ".png", false},
+		{"template with metadata", storage.ObjectInfo{
+			Key:      "named/x/a.png",
+			Metadata: map[string]string{"owner": "ann"},
+		}, "named/x/ann-a.png", false},
+		{"template with missing metadata", storage.ObjectInfo{
+			Key:      "named/x/a.png",
+			Metadata: map[string]string{},
+		}, "", true},
+		{"template of a missing object", storage.ObjectInfo{
+			Key:      "photos/missing.png",
+			Metadata: map[string]string{},
+		}, "", true},
+		{"no match", storage.ObjectInfo{Key: "ns-01/a.png"}, "ns-01/a.png", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteKey(context.Background(), tt.info)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteKeyWithoutRules(t *testing.T) {
+	withAppConfig(t)
+	config.RewriteRules = nil
+
+	got, err := rewriteKey(context.Background(), storage.ObjectInfo{Key: "ns-01/a.png"})
+	if err != nil || got != "ns-01/a.png" {
+		t.Errorf("got %q, %v, want the key unchanged", got, err)
+	}
+}
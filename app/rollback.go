@@ -0,0 +1,262 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// RollbackHandler copies what was written to the target after cutover back
+// to the source for the directories named by the did query parameter
+// (repeated or comma separated). Cutover is the directory's completed_at.
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if isRunning {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Migration is already running"))
+		return
+	}
+
+	var directories []string
+	for _, value := range r.URL.Query()["did"] {
+		for _, did := range strings.Split(value, ",") {
+			if did = strings.TrimSpace(did); did != "" {
+				directories = append(directories, did)
+			}
+		}
+	}
+	if len(directories) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Select the directories to roll back with did"))
+		return
+	}
+
+	go runMigration("rollback", directionReverse, func(ctx context.Context) error {
+		return rollbackDirectories(ctx, directories)
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Rolling back %d directories", len(directories))))
+}
+
+func rollbackDirectories(ctx context.Context, directories []string) error {
+	for _, did := range directories {
+		if err := ctx.Err(); err != nil {
+			logger(ctx).Info("Rollback stopped by context cancellation")
+			return err
+		}
+
+		dirCtx := withLogger(ctx, slog.String("directory", did))
+		dir, err := SelectDirectory(did)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && dir.CompletedAt.IsZero()) {
+			logger(dirCtx).Warn("Directory was never migrated, skipping")
+			continue
+		}
+		if err != nil {
+			logger(dirCtx).Error("Select directory Error", slog.Any("error", err))
+			continue
+		}
+
+		cutover := dir.CompletedAt
+		if err = StartDirectoryRollback(did, jobID(ctx)); err != nil {
+			logger(dirCtx).Error("Failed to update directory start time", slog.Any("error", err))
+			continue
+		}
+		logger(dirCtx).Info("Rolling back directory", slog.Time("cutover", cutover))
+
+		start := time.Now()
+		stats, err := rollbackDirectory(dirCtx, did, cutover)
+		if err != nil {
+			logger(dirCtx).Error("Rollback failed for directory", slog.Any("error", err))
+			if ctx.Err() != nil {
+				continue
+			}
+			stats.FailedFiles++
+		}
+		if err = MarkDirectoryAsRolledBack(did, jobID(ctx), stats); err != nil {
+			logger(dirCtx).Error("Failed to update directory completion time", slog.Any("error", err))
+		}
+
+		logger(dirCtx).Info("Directory rolled back",
+			slog.String("status", stats.Status()),
+			slog.Int64("total_files", stats.TotalFiles),
+			slog.Int64("migrated_files", stats.MigratedFiles),
+			slog.Int64("failed_files", stats.FailedFiles),
+			slog.Int64("bytes", stats.Bytes),
+			slog.Duration("duration", time.Since(start)))
+	}
+	return nil
+}
+
+// rollbackDirectory copies the target objects of a directory modified after
+// cutover back to the source. Keys migrated under another name are found
+// through their key mapping, as a rewrite rule may have moved them out of the
+// directory prefix. Keys referenced in dedup mode are included by the time
+// the reference was added.
+func rollbackDirectory(ctx context.Context, directory string, cutover time.Time) (DirectoryStats, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stats DirectoryStats
+	copyBack := func(key, sourceKey string) {
+		mu.Lock()
+		stats.TotalFiles++
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ctx.Err() != nil {
+				return
+			}
+			objCtx := withLogger(ctx, slog.String("key", key))
+			start := time.Now()
+			size, err := withRetry(objCtx, func() (int64, error) {
+				return rollbackObject(objCtx, key, sourceKey)
+			})
+			if err != nil {
+				logFailedFile(objCtx, directory, key, err)
+				mu.Lock()
+				stats.FailedFiles++
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			stats.MigratedFiles++
+			stats.Bytes += size
+			mu.Unlock()
+			markFileAsMigrated(objCtx, size, time.Since(start))
+		}()
+	}
+
+	mappings, err := SelectDirectoryKeyMappings(directory)
+	if err != nil {
+		return stats, err
+	}
+	seen := make(map[string]bool)
+	for _, mapping := range mappings {
+		if ctx.Err() != nil {
+			break
+		}
+		info, err := config.TargetStore.Stat(ctx, mapping.TargetKey)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Deduplicated, the reference is rolled back below
+			continue
+		}
+		if err != nil {
+			wg.Wait()
+			return stats, err
+		}
+		seen[mapping.TargetKey] = true
+		if info.LastModified.After(cutover) {
+			copyBack(mapping.TargetKey, mapping.SourceKey)
+		}
+	}
+
+	for object := range config.TargetStore.List(ctx, storage.ListOptions{Prefix: directory + "/", Recursive: true}) {
+		if object.Err != nil {
+			wg.Wait()
+			return stats, object.Err
+		}
+		if !seen[object.Key] && object.LastModified.After(cutover) {
+			seen[object.Key] = true
+			copyBack(object.Key, "")
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		wg.Wait()
+		return stats, err
+	}
+
+	references, err := SelectDirectoryReferencesSince(directory, cutover)
+	if err != nil {
+		wg.Wait()
+		return stats, err
+	}
+	for _, key := range references {
+		if !seen[key] {
+			copyBack(key, "")
+		}
+	}
+
+	wg.Wait()
+	return stats, ctx.Err()
+}
+
+// rollbackObject writes the original content of a target object to the
+// source under the key it was migrated from, looked up when sourceKey is
+// empty, and returns its size. Compression and client-side encryption are
+// undone on the way.
+func rollbackObject(ctx context.Context, targetKey, sourceKey string) (int64, error) {
+	ctx = context.WithoutCancel(ctx)
+
+	// A deduplicated key is only a reference to the blob holding the content
+	physicalKey := targetKey
+	var ref *BlobReference
+	if blobRef, err := SelectBlobReference(targetKey); err == nil {
+		physicalKey, ref = blobRef.BlobKey, &blobRef
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("failed to read blob reference: %w", err)
+	}
+
+	if sourceKey == "" {
+		mapped, err := SelectSourceKey(targetKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			mapped = targetKey
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to read key mapping: %w", err)
+		}
+		sourceKey = mapped
+	}
+
+	object, objInfo, err := config.TargetStore.Get(ctx, physicalKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get object from target: %w", err)
+	}
+	defer object.Close()
+	objInfo = referencedInfo(objInfo, ref)
+
+	body, err := decodeObject(object, objInfo)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode object: %w", err)
+	}
+	defer body.Close()
+
+	// Without object lock on the source the content is restored unlocked,
+	// and the object is still reported as its retention is lost
+	retention := objInfo.Retention
+	unlocked := !retention.IsZero() && !config.Source.ObjectLock
+	if unlocked {
+		retention = storage.Retention{}
+	}
+
+	size := plaintextSize(objInfo)
+	_, err = config.SourceStore.Put(ctx, sourceKey, body, size, storage.PutOptions{
+		ContentType: objInfo.ContentType,
+		Metadata:    decodedMetadata(objInfo.Metadata),
+		Retention:   retention,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to put object to source: %w", err)
+	}
+
+	source, err := config.SourceStore.Stat(ctx, sourceKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat object on source: %w", err)
+	}
+	if source.Size != size {
+		return 0, fmt.Errorf("%w: size %d, expected %d", errVerificationFailed, source.Size, size)
+	}
+	if unlocked {
+		return size, fmt.Errorf("%w: object lock is not enabled on the source bucket", errRetentionNotPreserved)
+	}
+	return size, nil
+}
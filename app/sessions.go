@@ -0,0 +1,489 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+	"github.com/MidhunRajeevan/s3-migration/util"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the tus protocol loosely: a session is created
+// with Upload-Length and Upload-Metadata, chunks are sent with PATCH at the
+// Upload-Offset reported by HEAD, and a POST on the session finalizes it.
+// Every chunk but the last must be at least storage.MinPartSize bytes, as
+// each becomes a part of an S3 multipart upload.
+
+// sessionMetadata parses an Upload-Metadata header: comma separated pairs of
+// a key and a base64 encoded value
+func sessionMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, " ")
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %w", key, err)
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata, nil
+}
+
+// restoreHash continues the SHA-256 of the chunks received so far
+func restoreHash(state []byte) (hash.Hash, error) {
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
+
+func saveHash(hasher hash.Hash) ([]byte, error) {
+	return hasher.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+func writeSessionOffset(w http.ResponseWriter, s UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func createUploadSession(w http.ResponseWriter, r *http.Request, objDir string, store storage.MultipartStore) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		util.BadRequest(&w, "invalid_upload_length")
+		return
+	}
+	if length > config.App.UploadLimit {
+		logger(ctx).Warn("file_too_big", slog.Int64("bytes", length))
+		util.BadRequest(&w, "file_too_big")
+		return
+	}
+
+	metadata, err := sessionMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		util.BadRequest(&w, "invalid_upload_metadata")
+		return
+	}
+	if metadata["filename"] == "" {
+		util.BadRequest(&w, "file_name_required")
+		return
+	}
+	contentType := metadata["filetype"]
+	if err = checkDeclaredType(ctx, objDir, metadata["filename"], contentType); err != nil {
+		util.UnsupportedMediaType(&w, "content_not_acceptable", acceptedTypes(objDir))
+		return
+	}
+
+	hashState, err := saveHash(sha256.New())
+	if err != nil {
+		logger(ctx).Error("hash_compute_error", slog.Any("error", err))
+		util.InternalServerError(&w, "hash_compute_error")
+		return
+	}
+
+	session := UploadSession{
+		ID:          uuid.NewString(),
+		Did:         objDir,
+		Tenant:      segments[1],
+		FileName:    metadata["filename"],
+		ContentType: contentType,
+		Length:      length,
+		HashState:   hashState,
+		Kind:        "multipart",
+		Status:      "open",
+	}
+	session.ObjectKey = fmt.Sprintf(".uploads/%s", session.ID)
+	session.UploadID, err = store.NewMultipartUpload(ctx, session.ObjectKey, storage.PutOptions{ContentType: contentType})
+	if err != nil {
+		logger(ctx).Error("s3_put_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+		util.InternalServerError(&w, "s3_put_error")
+		return
+	}
+	if err = CreateUploadSession(session); err != nil {
+		logger(ctx).Error("session_create_error", slog.Any("error", err))
+		store.AbortMultipartUpload(ctx, session.ObjectKey, session.UploadID)
+		util.InternalServerError(&w, "session_create_error")
+		return
+	}
+	logger(ctx).Info("Upload session created", slog.String("session_id", session.ID), slog.Int64("bytes", length))
+
+	w.Header().Set("Location", fmt.Sprintf("/%s/%s/%s/sessions/%s", segments[0], segments[1], segments[2], session.ID))
+	writeSessionOffset(w, session)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+func headUploadSession(w http.ResponseWriter, session UploadSession) {
+	writeSessionOffset(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+func patchUploadSession(w http.ResponseWriter, r *http.Request, session UploadSession, store storage.MultipartStore) {
+	ctx := r.Context()
+
+	if session.Status != "open" {
+		util.Conflict(&w, "session_closed")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		util.BadRequest(&w, "invalid_upload_offset")
+		return
+	}
+	if offset != session.Offset {
+		writeSessionOffset(w, session)
+		util.Conflict(&w, "offset_mismatch")
+		return
+	}
+
+	size := r.ContentLength
+	switch {
+	case size <= 0:
+		util.BadRequest(&w, "content_length_required")
+		return
+	case offset+size > session.Length:
+		util.BadRequest(&w, "chunk_exceeds_length")
+		return
+	case size < storage.MinPartSize && offset+size < session.Length:
+		util.BadRequest(&w, "chunk_too_small")
+		return
+	}
+
+	body := bufio.NewReaderSize(io.LimitReader(r.Body, size), 512)
+	if offset == 0 {
+		// Sniff the type from the first bytes before anything is stored
+		head, _ := body.Peek(262)
+		if err = checkUploadType(ctx, session.Did, session.FileName, session.ContentType, head); err != nil {
+			util.UnsupportedMediaType(&w, "content_not_acceptable", acceptedTypes(session.Did))
+			return
+		}
+	}
+
+	hasher, err := restoreHash(session.HashState)
+	if err != nil {
+		logger(ctx).Error("hash_compute_error", slog.Any("error", err))
+		util.InternalServerError(&w, "hash_compute_error")
+		return
+	}
+	number, err := ReserveUploadPart(session.ID, offset)
+	if errors.Is(err, errOffsetConflict) {
+		util.Conflict(&w, "offset_mismatch")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("session_update_error", slog.Any("error", err))
+		util.InternalServerError(&w, "session_update_error")
+		return
+	}
+
+	part, err := store.PutPart(ctx, session.ObjectKey, session.UploadID, number, io.TeeReader(body, hasher), size)
+	if err != nil {
+		logger(ctx).Error("s3_put_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+		util.InternalServerError(&w, "s3_put_error")
+		return
+	}
+	part.Size = size
+
+	hashState, err := saveHash(hasher)
+	if err != nil {
+		logger(ctx).Error("hash_compute_error", slog.Any("error", err))
+		util.InternalServerError(&w, "hash_compute_error")
+		return
+	}
+	err = AdvanceUploadSession(session.ID, offset, part, hashState)
+	if errors.Is(err, errOffsetConflict) {
+		util.Conflict(&w, "offset_mismatch")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("session_update_error", slog.Any("error", err))
+		util.InternalServerError(&w, "session_update_error")
+		return
+	}
+
+	session.Offset = offset + size
+	writeSessionOffset(w, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeUploadSession assembles the chunks and stores the file under its
+// SHA-256, through the same encoding and dedup as postUploads
+func finalizeUploadSession(w http.ResponseWriter, r *http.Request, session UploadSession, store storage.MultipartStore) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	if session.Status != "open" {
+		util.Conflict(&w, "session_closed")
+		return
+	}
+	if session.Offset != session.Length {
+		writeSessionOffset(w, session)
+		util.Conflict(&w, "upload_incomplete")
+		return
+	}
+
+	// A finalize retried after a failure finds the parts already joined
+	if _, err := store.Stat(ctx, session.ObjectKey); errors.Is(err, storage.ErrNotFound) {
+		parts, err := SelectUploadParts(session.ID)
+		if err != nil {
+			logger(ctx).Error("session_select_error", slog.Any("error", err))
+			util.InternalServerError(&w, "session_select_error")
+			return
+		}
+		if _, err = store.CompleteMultipartUpload(ctx, session.ObjectKey, session.UploadID, parts); err != nil {
+			logger(ctx).Error("s3_put_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+			util.InternalServerError(&w, "s3_put_error")
+			return
+		}
+	} else if err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.InternalServerError(&w, "get_object_error")
+		return
+	}
+
+	hasher, err := restoreHash(session.HashState)
+	if err != nil {
+		logger(ctx).Error("hash_compute_error", slog.Any("error", err))
+		util.InternalServerError(&w, "hash_compute_error")
+		return
+	}
+	objHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	urlPrefix := fmt.Sprintf("/%s/%s/%s", segments[0], segments[1], segments[2])
+	userMetadata, err := storeSessionUpload(ctx, session, urlPrefix, objHash)
+	if err != nil {
+		logger(ctx).Error("s3_put_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+		util.InternalServerError(&w, "s3_put_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(userMetadata)
+}
+
+// storeSessionUpload stores the assembled temporary object of a session under
+// the name derived from its hash, through the same encoding and dedup as
+// postUploads, and completes the session
+func storeSessionUpload(ctx context.Context, session UploadSession, urlPrefix, objHash string) (map[string]string, error) {
+	store := config.TargetStore
+	objName, objURL := uploadLocation(session.Did, urlPrefix, session.FileName, objHash)
+
+	userMetadata := make(map[string]string)
+	userMetadata["name"] = url.QueryEscape(session.FileName)
+	userMetadata["hash"] = objHash
+	userMetadata["url"] = objURL
+
+	start := time.Now()
+	put := func() error {
+		object, _, err := store.Get(ctx, session.ObjectKey)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		body, size, metadata, err := encodeObject(session.Did, session.ContentType, object, session.Length, userMetadata)
+		if err != nil {
+			return err
+		}
+		_, err = store.Put(ctx, objName, body, size, storage.PutOptions{ContentType: session.ContentType, Metadata: metadata})
+		return err
+	}
+	var err error
+	if config.App.Dedup {
+		_, err = putDeduplicated(ctx, session.Did, objName, session.ContentType, objHash, session.Length, userMetadata["name"], objURL, put)
+	} else {
+		err = put()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger(ctx).Info("Upload stored", slog.String("key", objName), slog.Int64("bytes", session.Length), slog.Duration("duration", time.Since(start)))
+	if err = ReplaceUploadDeletion(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+	}
+
+	if err = MarkUploadSession(session.ID, "completed"); err != nil {
+		logger(ctx).Error("session_update_error", slog.Any("error", err))
+	}
+	if err = store.Delete(context.WithoutCancel(ctx), session.ObjectKey); err != nil {
+		logger(ctx).Warn("Temporary upload not removed", slog.String("key", session.ObjectKey), slog.Any("error", err))
+	}
+	return userMetadata, nil
+}
+
+func deleteUploadSession(w http.ResponseWriter, r *http.Request, session UploadSession, store storage.MultipartStore) {
+	ctx := r.Context()
+
+	if session.Status != "open" {
+		util.Conflict(&w, "session_closed")
+		return
+	}
+	err := store.AbortMultipartUpload(ctx, session.ObjectKey, session.UploadID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		logger(ctx).Error("s3_abort_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+		util.InternalServerError(&w, "s3_abort_error")
+		return
+	}
+	if err = MarkUploadSession(session.ID, "aborted"); err != nil {
+		logger(ctx).Error("session_update_error", slog.Any("error", err))
+		util.InternalServerError(&w, "session_update_error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadSessions API
+func UploadSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	store, ok := config.TargetStore.(storage.MultipartStore)
+	if !ok {
+		util.NotImplemented(&w, "sessions_not_supported")
+		return
+	}
+
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+	r = r.WithContext(withLogger(ctx, slog.String("directory", objDir)))
+
+	switch len(segments) {
+	case 4: // /tenants/1/uploads/sessions
+		if r.Method != http.MethodPost {
+			util.MethodNotAllowed(&w, "method_not_allowed")
+			return
+		}
+		createUploadSession(w, r, objDir, store)
+		return
+	case 5: // /tenants/1/uploads/sessions/1
+	default:
+		util.NotFound(&w, "path_not_found")
+		return
+	}
+
+	session, err := SelectUploadSession(segments[4])
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (session.Did != objDir || session.Kind != "multipart")) {
+		util.NotFound(&w, "session_not_found")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("session_select_error", slog.Any("error", err))
+		util.InternalServerError(&w, "session_select_error")
+		return
+	}
+	r = r.WithContext(withLogger(r.Context(), slog.String("session_id", session.ID)))
+
+	switch r.Method {
+	case http.MethodHead:
+		headUploadSession(w, session)
+	case http.MethodPatch:
+		patchUploadSession(w, r, session, store)
+	case http.MethodPost:
+		finalizeUploadSession(w, r, session, store)
+	case http.MethodDelete:
+		deleteUploadSession(w, r, session, store)
+	default:
+		util.MethodNotAllowed(&w, "method_not_allowed")
+	}
+}
+
+// sessionExpiryInterval between checks for idle upload sessions
+const sessionExpiryInterval = time.Minute
+
+// sessionExpiryBatch bounds the sessions expired per sweep
+const sessionExpiryBatch = 100
+
+// sessionExpiryMu keeps sweeps from overlapping when one runs longer than
+// the interval
+var sessionExpiryMu sync.Mutex
+
+// StartSessionExpirer expires upload and presigned sessions left idle for
+// longer than config.App.SessionExpiry, removing what they uploaded. It
+// returns immediately and sweeps in the background.
+func StartSessionExpirer() {
+	ctx := withLogger(context.Background(), slog.String("kind", "session_expiry"))
+	go func() {
+		ticker := time.NewTicker(sessionExpiryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireUploadSessions(ctx)
+		}
+	}()
+}
+
+// expireUploadSessions expires at most sessionExpiryBatch idle sessions. A
+// session whose upload could not be removed stays open and is tried again on
+// the next sweep.
+func expireUploadSessions(ctx context.Context) {
+	sessionExpiryMu.Lock()
+	defer sessionExpiryMu.Unlock()
+
+	idle, err := SelectIdleUploadSessions(time.Now().Add(-config.App.SessionExpiry), sessionExpiryBatch)
+	if err != nil {
+		logger(ctx).Error("Select idle sessions Error", slog.Any("error", err))
+		return
+	}
+
+	for _, session := range idle {
+		sessionCtx := withLogger(ctx, slog.String("directory", session.Did), slog.String("session_id", session.ID))
+		if err := removeSessionUpload(sessionCtx, session); err != nil {
+			logger(sessionCtx).Warn("Session upload not removed", slog.Any("error", err))
+			continue
+		}
+		if err := MarkUploadSession(session.ID, "expired"); err != nil {
+			logger(sessionCtx).Error("Failed to update upload session", slog.Any("error", err))
+			continue
+		}
+		logger(sessionCtx).Info("Upload session expired", slog.Time("updated_at", session.UpdatedAt))
+	}
+}
+
+// removeSessionUpload discards what an unfinished session uploaded: the
+// multipart upload, its assembled object when a finalize failed late, or the
+// object a presigned upload left
+func removeSessionUpload(ctx context.Context, session UploadSession) error {
+	if store, ok := config.TargetStore.(storage.MultipartStore); ok && session.Kind == "multipart" {
+		err := store.AbortMultipartUpload(ctx, session.ObjectKey, session.UploadID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	err := config.TargetStore.Delete(ctx, session.ObjectKey)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
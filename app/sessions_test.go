@@ -0,0 +1,94 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+func TestUploadSessionParts(t *testing.T) {
+	newTestDB(t)
+
+	session := UploadSession{
+		ID:          "session-1",
+		Kind:        "multipart",
+		Did:         "ns-01",
+		Tenant:      "tenants",
+		FileName:    "a.png",
+		ContentType: "image/png",
+		ObjectKey:   "ns-01/.uploads/session-1",
+		UploadID:    "upload-1",
+		Length:      30,
+	}
+	if err := CreateUploadSession(session); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two chunks racing at the same offset get their own part numbers, the
+	// first to advance wins and the other has to start over
+	steps := []struct {
+		name    string
+		advance bool
+		offset  int64
+		part    storage.Part
+		want    int
+		wantErr error
+	}{
+		{name: "reserve", offset: 0, want: 1},
+		{name: "reserve concurrently", offset: 0, want: 2},
+		{name: "advance the second", advance: true, offset: 0, part: storage.Part{Number: 2, ETag: "b", Size: 10}},
+		{name: "advance the first", advance: true, offset: 0, part: storage.Part{Number: 1, ETag: "a", Size: 10}, wantErr: errOffsetConflict},
+		{name: "reserve at the old offset", offset: 0, wantErr: errOffsetConflict},
+		{name: "reserve at the new offset", offset: 10, want: 3},
+		{name: "advance", advance: true, offset: 10, part: storage.Part{Number: 3, ETag: "c", Size: 10}},
+	}
+	for _, step := range steps {
+		var number int
+		var err error
+		if step.advance {
+			err = AdvanceUploadSession(session.ID, step.offset, step.part, []byte("state"))
+		} else {
+			number, err = ReserveUploadPart(session.ID, step.offset)
+		}
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: got %v, want %v", step.name, err, step.wantErr)
+		}
+		if number != step.want {
+			t.Fatalf("%s: got part %d, want %d", step.name, number, step.want)
+		}
+	}
+
+	parts, err := SelectUploadParts(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.Part{{Number: 2, ETag: "b", Size: 10}, {Number: 3, ETag: "c", Size: 10}}
+	if len(parts) != len(want) {
+		t.Fatalf("got parts %v, want %v", parts, want)
+	}
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Errorf("part %d: got %v, want %v", i, parts[i], want[i])
+		}
+	}
+
+	got, err := SelectUploadSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Offset != 20 || string(got.HashState) != "state" {
+		t.Errorf("got offset %d, hash state %q", got.Offset, got.HashState)
+	}
+
+	// A session that is no longer open takes no more chunks
+	if err = MarkUploadSession(session.ID, "aborted"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReserveUploadPart(session.ID, 20); !errors.Is(err, errOffsetConflict) {
+		t.Errorf("reserve on an aborted session: got %v, want errOffsetConflict", err)
+	}
+	if err = AdvanceUploadSession(session.ID, 20, storage.Part{Number: 4, ETag: "d", Size: 10}, nil); !errors.Is(err, errOffsetConflict) {
+		t.Errorf("advance on an aborted session: got %v, want errOffsetConflict", err)
+	}
+}
@@ -0,0 +1,28 @@
+package app
+
+import (
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// storageClass returns the target storage class of the first tiering rule
+// matching the object, or "" for the bucket default
+func storageClass(did string, info storage.ObjectInfo) string {
+	for _, rule := range config.TieringRules {
+		if rule.Directory != "" && rule.Directory != did {
+			continue
+		}
+		if rule.MinAgeDays > 0 {
+			if info.LastModified.IsZero() {
+				continue
+			}
+			if time.Since(info.LastModified) < time.Duration(rule.MinAgeDays)*24*time.Hour {
+				continue
+			}
+		}
+		return rule.StorageClass
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+	"github.com/MidhunRajeevan/s3-migration/util"
+)
+
+// Deleted uploads stay in the stores until the restore window closes. Reads
+// treat them as missing; the purger then removes the content.
+
+// AuthorizeUpload decides whether a request may act on an upload. action is
+// delete or restore, or import or export for the archive of a directory,
+// when key is empty. It returns an error to refuse. The default requires the
+// admin token; without a hook every request is refused.
+var AuthorizeUpload = authorizeAdminToken
+
+// authorizeAdminToken accepts requests bearing config.App.AdminToken
+func authorizeAdminToken(r *http.Request, action, did, key string) error {
+	if config.App.AdminToken == "" {
+		return errors.New("no admin token configured")
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.App.AdminToken)) != 1 {
+		return errors.New("invalid admin token")
+	}
+	return nil
+}
+
+// purgeInterval between checks for deletions whose restore window closed
+const purgeInterval = time.Minute
+
+// purgeBatch bounds the deletions purged per sweep
+const purgeBatch = 100
+
+// purgeMu keeps sweeps from overlapping when one runs longer than the interval
+var purgeMu sync.Mutex
+
+// uploadDeleted reports whether an upload has a pending deletion
+func uploadDeleted(objName string) (bool, error) {
+	_, err := SelectUploadDeletion(objName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// authorizeUpload applies the AuthorizeUpload hook and writes the refusal
+func authorizeUpload(w http.ResponseWriter, r *http.Request, action, did, key string) bool {
+	err := errors.New("no authorization configured")
+	if AuthorizeUpload != nil {
+		err = AuthorizeUpload(r, action, did, key)
+	}
+	if err != nil {
+		logger(r.Context()).Warn("upload_forbidden", slog.String("action", action), slog.Any("error", err))
+		util.Forbidden(&w, "forbidden")
+		return false
+	}
+	return true
+}
+
+func deleteUploads(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx := r.Context()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+
+	objName := fmt.Sprintf("%s/%s", objDir, segments[3])
+	ctx = withLogger(ctx, slog.String("directory", objDir), slog.String("key", objName))
+	r = r.WithContext(ctx)
+
+	if !authorizeUpload(w, r, "delete", objDir, objName) {
+		return
+	}
+
+	store, objKey, _, err := resolveUpload(ctx, objName)
+	if err != nil {
+		logger(ctx).Error("key_mapping_error", slog.Any("error", err))
+		util.InternalServerError(&w, "key_mapping_error")
+		return
+	}
+	if _, err = store.Stat(ctx, objKey); err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.NotFound(&w, "get_object_error")
+		return
+	}
+
+	deletion, err := DeleteUpload(objDir, objName, time.Now().Add(config.App.RestoreWindow))
+	if errors.Is(err, errAlreadyDeleted) {
+		util.NotFound(&w, "object_deleted")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	}
+	logger(ctx).Info("Upload deleted", slog.Time("purge_after", deletion.PurgeAfter))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deletion)
+}
+
+func restoreUploads(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx := r.Context()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+
+	objName := fmt.Sprintf("%s/%s", objDir, segments[3])
+	ctx = withLogger(ctx, slog.String("directory", objDir), slog.String("key", objName))
+	r = r.WithContext(ctx)
+
+	if !authorizeUpload(w, r, "restore", objDir, objName) {
+		return
+	}
+
+	err = RestoreUpload(objName)
+	if errors.Is(err, sql.ErrNoRows) {
+		util.NotFound(&w, "deletion_not_found")
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("restore_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "restore_record_error")
+		return
+	}
+	logger(ctx).Info("Upload restored")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartUploadPurger removes the content of deleted uploads once their restore
+// window closed. It returns immediately and sweeps in the background.
+func StartUploadPurger() {
+	ctx := withLogger(context.Background(), slog.String("kind", "upload_purge"))
+	go func() {
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			purgeUploads(ctx)
+		}
+	}()
+}
+
+// purgeUploads purges at most purgeBatch due deletions. A failed purge stays
+// pending and is tried again on the next sweep.
+func purgeUploads(ctx context.Context) {
+	purgeMu.Lock()
+	defer purgeMu.Unlock()
+
+	due, err := SelectDuePurges(purgeBatch)
+	if err != nil {
+		logger(ctx).Error("Select due purges Error", slog.Any("error", err))
+		return
+	}
+
+	for _, deletion := range due {
+		delCtx := withLogger(ctx, slog.String("directory", deletion.Did), slog.String("key", deletion.ObjectKey))
+		status, message := "purged", ""
+		if err := purgeUpload(delCtx, deletion.ObjectKey); err != nil {
+			status, message = "deleted", err.Error()
+			logger(delCtx).Warn("Upload not purged", slog.Any("error", err))
+		} else {
+			logger(delCtx).Info("Upload purged")
+		}
+		if err := MarkUploadPurged(deletion.ID, status, message); err != nil {
+			logger(delCtx).Error("Failed to update upload deletion", slog.Any("error", err))
+		}
+	}
+}
+
+// purgeUpload removes an upload from the target, releasing its dedup
+// reference, and from the source so a later migration does not bring it back
+func purgeUpload(ctx context.Context, objName string) error {
+	targetKey := objName
+	if key, err := SelectKeyMapping(objName); err == nil {
+		targetKey = key
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err := deleteDeduplicated(ctx, targetKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete from target: %w", err)
+	}
+	if err := config.SourceStore.Delete(ctx, objName); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to delete from source: %w", err)
+	}
+	return nil
+}
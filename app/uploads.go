@@ -5,234 +5,707 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/envelope"
+	"github.com/MidhunRajeevan/s3-migration/storage"
 	"github.com/MidhunRajeevan/s3-migration/util"
+	"github.com/google/uuid"
 	"github.com/h2non/filetype"
-	"github.com/minio/minio-go/v7"
 )
 
+// uploadMetadata is the user metadata postUploads stores with a file
+type uploadMetadata struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
 func getUploadDetails(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	type metadata struct {
-		Hash string `json:"hash"`
-		Name string `json:"name"`
-		URL  string `json:"url"`
-	}
-
-	ctx := context.Background()
-	s3Client := config.SourceClient
+	ctx := r.Context()
 
 	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	re, err := regexp.Compile("[^a-zA-Z0-9]+")
 	if err != nil {
-		log.Println("name_process_error", err)
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
 		util.InternalServerError(&w, "name_process_error")
 		return
 	}
 	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
 
 	objName := fmt.Sprintf("%s/%s", objDir, segments[3])
+	ctx = withLogger(ctx, slog.String("directory", objDir), slog.String("key", objName))
+
+	if deleted, err := uploadDeleted(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	} else if deleted {
+		util.NotFound(&w, "object_deleted")
+		return
+	}
 
-	objInfo, err := s3Client.StatObject(ctx, config.Source.Bucket, objName, minio.StatObjectOptions{})
+	store, objKey, ref, err := resolveUpload(ctx, objName)
 	if err != nil {
-		log.Println("get_object_error", err)
-		util.NotFound(&w, "get_object_error")
+		logger(ctx).Error("key_mapping_error", slog.Any("error", err))
+		util.InternalServerError(&w, "key_mapping_error")
 		return
 	}
 
-	keys := []string{"etag", "name", "lastModified", "size", "contentType", "userMetadata"}
-	var objStat map[string]interface{}
-	objStr, _ := json.Marshal(objInfo)
-	json.Unmarshal(objStr, &objStat)
-	var objMeta metadata
-	for key, val := range objStat {
-		if !util.Contains(keys, key) {
-			delete(objStat, key)
-		} else if key == "userMetadata" {
-			objMetaStr, _ := json.Marshal(val)
-			json.Unmarshal(objMetaStr, &objMeta)
-			delete(objStat, "userMetadata")
-		}
+	objInfo, err := store.Stat(ctx, objKey)
+	if err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.NotFound(&w, "get_object_error")
+		return
+	}
+	objInfo = referencedInfo(objInfo, ref)
+	objInfo.Size = plaintextSize(objInfo)
+
+	objStat := map[string]interface{}{
+		"etag":         objInfo.ETag,
+		"name":         objInfo.Key,
+		"lastModified": objInfo.LastModified,
+		"size":         objInfo.Size,
+		"contentType":  objInfo.ContentType,
+		"metadata": uploadMetadata{
+			Hash: objInfo.Metadata["hash"],
+			Name: objInfo.Metadata["name"],
+			URL:  objInfo.Metadata["url"],
+		},
 	}
-	objStat["metadata"] = objMeta
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(objStat)
 }
 
 func getUploads(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	ctx := context.Background()
-	s3Client := config.SourceClient
+	ctx := r.Context()
 
 	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	re, err := regexp.Compile("[^a-zA-Z0-9]+")
 	if err != nil {
-		log.Println("name_process_error", err)
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
 		util.InternalServerError(&w, "name_process_error")
 		return
 	}
 	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
 
 	objName := fmt.Sprintf("%s/%s", objDir, segments[3])
+	ctx = withLogger(ctx, slog.String("directory", objDir), slog.String("key", objName))
+
+	if deleted, err := uploadDeleted(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	} else if deleted {
+		util.NotFound(&w, "object_deleted")
+		return
+	}
+
+	store, objKey, ref, err := resolveUpload(ctx, objName)
+	if err != nil {
+		logger(ctx).Error("key_mapping_error", slog.Any("error", err))
+		util.InternalServerError(&w, "key_mapping_error")
+		return
+	}
 
-	var objInfo minio.ObjectInfo
-	object, err := s3Client.GetObject(ctx, config.Source.Bucket, objName, minio.GetObjectOptions{})
+	object, objInfo, err := store.Get(ctx, objKey)
 	if err != nil {
-		log.Println("get_object_error", err)
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
 		util.NotFound(&w, "get_object_error")
 		return
 	}
 	defer object.Close()
+	objInfo = referencedInfo(objInfo, ref)
 
-	objInfo, err = object.Stat()
-	if err == nil {
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", objInfo.ContentType)
-		if _, err = io.Copy(w, object); err != nil {
-			log.Println("object_copy_error", err)
-			util.InternalServerError(&w, "object_copy_error")
-			return
+	var body io.Reader
+	var size int64
+	if body, size, err = openObject(object, objInfo); err != nil {
+		logger(ctx).Error("decrypt_object_error", slog.Any("error", err))
+		util.InternalServerError(&w, "decrypt_object_error")
+		return
+	}
+
+	// Compressed objects are sent as stored when the client accepts the
+	// encoding, and decompressed otherwise, unless identity is refused too
+	encoding := objInfo.Metadata[metaEncoding]
+	if (encoding == "" || !acceptsEncoding(r, encoding)) && !acceptsEncoding(r, "identity") {
+		util.NotAcceptable(&w, "encoding_not_acceptable")
+		return
+	}
+	if encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r, encoding) {
+			w.Header().Set("Content-Encoding", encoding)
+		} else {
+			decompressed, err := decompress(body, encoding)
+			if err != nil {
+				logger(ctx).Error("decompress_object_error", slog.Any("error", err))
+				util.InternalServerError(&w, "decompress_object_error")
+				return
+			}
+			defer decompressed.Close()
+			body = decompressed
+			size = -1
+			if length, err := strconv.ParseInt(objInfo.Metadata[metaDecodedLength], 10, 64); err == nil {
+				size = length
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", objInfo.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition(r, objInfo))
+	w.Header().Set("Cache-Control", config.App.CacheControl)
+	etag := strings.Trim(objInfo.ETag, `"`)
+
+	// The stored bytes are served as they are, ranges and conditional
+	// requests included
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		if etag != "" {
+			w.Header().Set("ETag", fmt.Sprintf(`"%s"`, etag))
 		}
+		http.ServeContent(w, r, "", objInfo.LastModified, seeker)
 		return
 	}
+
+	// Decrypted or decompressed content cannot seek, it is always sent whole
+	if etag != "" {
+		w.Header().Set("ETag", fmt.Sprintf(`W/"%s"`, etag))
+	}
+	w.Header().Set("Accept-Ranges", "none")
+	if !objInfo.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", objInfo.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, objInfo.LastModified) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, body); err != nil {
+		logger(ctx).Error("object_copy_error", slog.Any("error", err))
+	}
 }
 
-func postUploads(w http.ResponseWriter, r *http.Request) {
+// headUploads answers with the headers getUploads would send, from the
+// object metadata alone
+func headUploads(w http.ResponseWriter, r *http.Request) {
 	var err error
 
-	ctx := context.Background()
-	s3Client := config.TargetClient
+	ctx := r.Context()
 
 	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	re, err := regexp.Compile("[^a-zA-Z0-9]+")
 	if err != nil {
-		log.Println("name_process_error", err)
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
 		util.InternalServerError(&w, "name_process_error")
 		return
 	}
 	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
 
-	err = r.ParseMultipartForm(32 << 20)
+	objName := fmt.Sprintf("%s/%s", objDir, segments[3])
+	ctx = withLogger(ctx, slog.String("directory", objDir), slog.String("key", objName))
+
+	if deleted, err := uploadDeleted(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+		util.InternalServerError(&w, "delete_record_error")
+		return
+	} else if deleted {
+		util.NotFound(&w, "object_deleted")
+		return
+	}
+
+	store, objKey, ref, err := resolveUpload(ctx, objName)
 	if err != nil {
-		log.Println("form_parse_error", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		logger(ctx).Error("key_mapping_error", slog.Any("error", err))
+		util.InternalServerError(&w, "key_mapping_error")
 		return
 	}
 
-	// for every file in multipart
-	var response []map[string]string
-	for _, fhs := range r.MultipartForm.File {
-		for _, fh := range fhs {
-			var f multipart.File
-			if f, err = fh.Open(); nil != err {
-				log.Println("file_open_error", err)
-				util.BadRequest(&w, "file_open_error")
-				return
+	objInfo, err := store.Stat(ctx, objKey)
+	if err != nil {
+		logger(ctx).Error("get_object_error", slog.Any("error", err))
+		util.NotFound(&w, "get_object_error")
+		return
+	}
+	objInfo = referencedInfo(objInfo, ref)
+
+	// Same representation as getUploads: as stored unless it has to be
+	// decrypted or decompressed
+	size := objInfo.Size
+	encrypted := envelope.IsEncrypted(objInfo.Metadata)
+	if encrypted {
+		size = envelope.DecryptedSize(objInfo.Size)
+	}
+	encoding := objInfo.Metadata[metaEncoding]
+	accepted := encoding == "" || acceptsEncoding(r, encoding)
+	if (encoding == "" || !accepted) && !acceptsEncoding(r, "identity") {
+		util.NotAcceptable(&w, "encoding_not_acceptable")
+		return
+	}
+	if encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if accepted {
+			w.Header().Set("Content-Encoding", encoding)
+		} else {
+			size = -1
+			if length, err := strconv.ParseInt(objInfo.Metadata[metaDecodedLength], 10, 64); err == nil {
+				size = length
 			}
+		}
+	}
 
-			content, err := ioutil.ReadAll(f)
-			if err != nil {
-				log.Println("file_read_error", err)
-				util.BadRequest(&w, "file_read_error")
-				return
-			}
+	etag := strings.Trim(objInfo.ETag, `"`)
+	asStored := !encrypted && accepted
+	w.Header().Set("Content-Type", objInfo.ContentType)
+	w.Header().Set("Content-Disposition", contentDisposition(r, objInfo))
+	w.Header().Set("Cache-Control", config.App.CacheControl)
+	if etag != "" {
+		if asStored {
+			w.Header().Set("ETag", fmt.Sprintf(`"%s"`, etag))
+		} else {
+			w.Header().Set("ETag", fmt.Sprintf(`W/"%s"`, etag))
+		}
+	}
+	if asStored {
+		w.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+	if !objInfo.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", objInfo.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, objInfo.LastModified) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-			hasher := sha256.New()
-			if _, err := io.Copy(hasher, bytes.NewReader(content)); err != nil {
-				log.Println("hash_compute_error", err)
-				util.InternalServerError(&w, "hash_compute_error")
-				return
-			}
-			objHash := fmt.Sprintf("%x", hasher.Sum(nil))
-			objExt := filepath.Ext(fh.Filename)
-			objName := fmt.Sprintf("%s/%s%s", objDir, objHash, objExt)
-			objFile := fmt.Sprintf("%s%s", objHash, objExt)
-			objURL := fmt.Sprintf("/%s/%s/%s/%s", segments[0], segments[1], segments[2], objFile)
-			objSize := fh.Size
-
-			// validate
-			if objSize > config.App.UploadLimit {
-				log.Println("file_too_big", objSize)
-				util.BadRequest(&w, "file_too_big")
-				return
-			}
+// contentDisposition names a download after the original file name kept in
+// the name metadata, inline unless the request asks for ?download=1. The name
+// is sent RFC 5987 encoded, with an ASCII fallback for older clients.
+func contentDisposition(r *http.Request, info storage.ObjectInfo) string {
+	disposition := "inline"
+	if download := r.URL.Query().Get("download"); download == "1" || strings.EqualFold(download, "true") {
+		disposition = "attachment"
+	}
 
-			contentType := fh.Header.Get("Content-Type")
-			if len(contentType) > 0 && !util.Contains(config.App.ContentTypes, contentType) {
-				log.Println("content_not_acceptable", contentType)
-				util.BadRequest(&w, "content_not_acceptable")
-				return
-			}
+	name, err := url.QueryUnescape(info.Metadata["name"])
+	if err != nil {
+		name = info.Metadata["name"]
+	}
+	if name == "" {
+		return disposition
+	}
 
-			kind, _ := filetype.Match(content)
-			if len(kind.MIME.Value) <= 0 && !util.Contains(config.App.ContentTypes, kind.MIME.Value) {
-				log.Println("content_not_acceptable", kind.MIME.Value)
-				util.BadRequest(&w, "content_not_acceptable")
-				return
-			}
+	var fallback, encoded strings.Builder
+	for _, c := range name {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(c)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
 
-			userMetadata := make(map[string]string)
-			userMetadata["name"] = url.QueryEscape(fh.Filename)
-			userMetadata["hash"] = objHash
-			userMetadata["url"] = objURL
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
 
-			opts := minio.PutObjectOptions{ContentType: contentType, UserMetadata: userMetadata}
-			_, err = s3Client.PutObject(ctx, config.Target.Bucket, objName, bytes.NewReader(content), objSize, opts)
-			if err != nil {
-				log.Println("s3_put_error", err)
-				util.InternalServerError(&w, "s3_put_error")
-				return
+// notModified evaluates If-None-Match, or If-Modified-Since without it, for a
+// response that http.ServeContent cannot serve. ETags compare weakly.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etag != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`) == etag {
+				return true
 			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.IsZero() {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// errFileTooBig and errContentNotAcceptable reject an upload part
+var (
+	errFileTooBig           = errors.New("file too big")
+	errContentNotAcceptable = errors.New("content not acceptable")
+)
+
+// uploadLimitReader fails once more than limit bytes were read, so an
+// oversized upload is cut off mid-stream
+type uploadLimitReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		return n, errFileTooBig
+	}
+	return n, err
+}
 
-			response = append(response, userMetadata)
+// acceptedTypes returns the content types uploads to a directory may have
+func acceptedTypes(did string) []string {
+	if types, ok := config.App.TenantContentTypes[did]; ok {
+		return types
+	}
+	return config.App.ContentTypes
+}
+
+// canonicalType strips parameters and folds aliases such as image/jpg, so
+// types from headers, extensions and magic bytes compare
+func canonicalType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	if mediaType == "image/jpg" || mediaType == "image/pjpeg" {
+		return "image/jpeg"
+	}
+	return mediaType
+}
+
+// extensionType returns the type a file name claims by its extension
+func extensionType(fileName string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+	if ext == "" {
+		return ""
+	}
+	if kind := filetype.GetType(ext); kind != filetype.Unknown {
+		return canonicalType(kind.MIME.Value)
+	}
+	return canonicalType(mime.TypeByExtension("." + ext))
+}
+
+func isAccepted(did, contentType string) bool {
+	for _, accepted := range acceptedTypes(did) {
+		if canonicalType(accepted) == contentType {
+			return true
 		}
 	}
+	return false
+}
+
+// checkDeclaredType applies the accepted types of the directory to the
+// declared type, which the file extension must agree with. Without a
+// declared type there is nothing to check here, and application/octet-stream
+// leaves the type to the content, checkUploadType judges both by the sniffed
+// and the extension type.
+func checkDeclaredType(ctx context.Context, did, fileName, contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	declared := canonicalType(contentType)
+	if declared == "" || !isAccepted(did, declared) {
+		logger(ctx).Warn("content_not_acceptable", slog.String("content_type", contentType))
+		return errContentNotAcceptable
+	}
+	if declared != "application/octet-stream" && extensionType(fileName) != declared {
+		logger(ctx).Warn("content_not_acceptable", slog.String("content_type", contentType), slog.String("file_name", fileName))
+		return errContentNotAcceptable
+	}
+	return nil
+}
+
+// checkUploadType also requires the type sniffed from the first bytes of the
+// file to be accepted and to agree with the declared type and the extension.
+// Content without a known signature passes only as application/octet-stream,
+// and only under an extension of an accepted type that has no signature
+// itself, so shell.php or a renamed file is refused.
+func checkUploadType(ctx context.Context, did, fileName, contentType string, head []byte) error {
+	if err := checkDeclaredType(ctx, did, fileName, contentType); err != nil {
+		return err
+	}
+
+	kind, _ := filetype.Match(head)
+	sniffed := canonicalType(kind.MIME.Value)
+	declared := canonicalType(contentType)
+	if sniffed == "" {
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+		extType := extensionType(fileName)
+		if (contentType != "" && declared != "application/octet-stream") ||
+			extType == "" || !isAccepted(did, extType) || filetype.IsSupported(ext) {
+			logger(ctx).Warn("content_not_acceptable",
+				slog.String("content_type", contentType),
+				slog.String("sniffed_type", "unknown"),
+				slog.String("file_name", fileName))
+			return errContentNotAcceptable
+		}
+		return nil
+	}
+
+	if !isAccepted(did, sniffed) ||
+		(contentType != "" && declared != "application/octet-stream" && declared != sniffed) ||
+		extensionType(fileName) != sniffed {
+		logger(ctx).Warn("content_not_acceptable",
+			slog.String("content_type", contentType),
+			slog.String("sniffed_type", sniffed),
+			slog.String("file_name", fileName))
+		return errContentNotAcceptable
+	}
+	return nil
+}
+
+// uploadLocation returns the key and URL of an upload named by its hash
+func uploadLocation(objDir, urlPrefix, fileName, hash string) (string, string) {
+	objExt := filepath.Ext(fileName)
+	objName := fmt.Sprintf("%s/%s%s", objDir, hash, objExt)
+	objFile := fmt.Sprintf("%s%s", hash, objExt)
+	return objName, fmt.Sprintf("%s/%s", urlPrefix, objFile)
+}
+
+// streamUpload stores one file part without holding it in memory. The part
+// is streamed to a temporary key while it is hashed, then copied to the name
+// derived from the hash.
+func streamUpload(ctx context.Context, objDir, urlPrefix string, part *multipart.Part) (map[string]string, error) {
+	store := config.TargetStore
+
+	// Sniff the type from the first bytes before anything is stored
+	head := make([]byte, 262)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType := part.Header.Get("Content-Type")
+	if err = checkUploadType(ctx, objDir, part.FileName(), contentType, head); err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	limited := &uploadLimitReader{r: io.MultiReader(bytes.NewReader(head), part), limit: config.App.UploadLimit}
+	userMetadata := make(map[string]string)
+	userMetadata["name"] = url.QueryEscape(part.FileName())
+
+	start := time.Now()
+	body, _, metadata, err := encodeObject(objDir, contentType, io.TeeReader(limited, hasher), -1, userMetadata)
+	if err != nil {
+		return nil, err
+	}
+	tmpKey := fmt.Sprintf(".uploads/%s", uuid.NewString())
+	_, err = store.Put(ctx, tmpKey, body, -1, storage.PutOptions{ContentType: contentType, Metadata: metadata})
+	defer func() {
+		if err := store.Delete(context.WithoutCancel(ctx), tmpKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger(ctx).Warn("Temporary upload not removed", slog.String("key", tmpKey), slog.Any("error", err))
+		}
+	}()
+	if limited.n > limited.limit {
+		logger(ctx).Warn("file_too_big", slog.Int64("bytes", limited.n))
+		return nil, errFileTooBig
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	objHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	objName, objURL := uploadLocation(objDir, urlPrefix, part.FileName(), objHash)
+	objSize := limited.n
+
+	userMetadata["hash"] = objHash
+	userMetadata["url"] = objURL
+
+	finalMetadata := make(map[string]string, len(metadata)+3)
+	for k, v := range metadata {
+		finalMetadata[k] = v
+	}
+	finalMetadata["hash"] = objHash
+	finalMetadata["url"] = objURL
+	if metadata[metaEncoding] != "" {
+		finalMetadata[metaDecodedLength] = strconv.FormatInt(objSize, 10)
+	}
+
+	put := func() error {
+		_, err := store.Copy(ctx, tmpKey, objName, storage.PutOptions{ContentType: contentType, Metadata: finalMetadata})
+		return err
+	}
+	if config.App.Dedup {
+		_, err = putDeduplicated(ctx, objDir, objName, contentType, objHash, objSize, userMetadata["name"], objURL, put)
+	} else {
+		err = put()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger(ctx).Info("Upload stored", slog.String("key", objName), slog.Int64("bytes", objSize), slog.Duration("duration", time.Since(start)))
+	if err = ReplaceUploadDeletion(objName); err != nil {
+		logger(ctx).Error("delete_record_error", slog.Any("error", err))
+	}
+
+	return userMetadata, nil
+}
+
+func postUploads(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx := r.Context()
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	re, err := regexp.Compile("[^a-zA-Z0-9]+")
+	if err != nil {
+		logger(ctx).Error("name_process_error", slog.Any("error", err))
+		util.InternalServerError(&w, "name_process_error")
+		return
+	}
+	objDir := re.ReplaceAllString(strings.ToLower(segments[1]), "-")
+	urlPrefix := fmt.Sprintf("/%s/%s/%s", segments[0], segments[1], segments[2])
+	ctx = withLogger(ctx, slog.String("directory", objDir))
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		logger(ctx).Error("form_parse_error", slog.Any("error", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// for every file in multipart, one part at a time
+	var response []map[string]string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger(ctx).Error("form_parse_error", slog.Any("error", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		userMetadata, err := streamUpload(ctx, objDir, urlPrefix, part)
+		part.Close()
+		switch {
+		case errors.Is(err, errFileTooBig):
+			util.BadRequest(&w, "file_too_big")
+			return
+		case errors.Is(err, errContentNotAcceptable):
+			util.UnsupportedMediaType(&w, "content_not_acceptable", acceptedTypes(objDir))
+			return
+		case err != nil:
+			logger(ctx).Error("s3_put_error", slog.String("error_code", errorCode(err)), slog.Any("error", err))
+			util.InternalServerError(&w, "s3_put_error")
+			return
+		}
+
+		response = append(response, userMetadata)
+	}
 
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
 // Uploads API
 func Uploads(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Method, r.URL.Path)
-
 	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
 	if !((segments[0] == config.App.TenantString) && (segments[2] == "uploads")) {
 		util.NotFound(&w, "path_not_found")
 		return
 	}
 
+	// Resumable uploads, /tenants/1/uploads/sessions[/{id}]
+	if len(segments) > 3 && segments[3] == "sessions" {
+		UploadSessions(w, r)
+		return
+	}
+
+	// Direct to bucket uploads, /tenants/1/uploads/presigned[/{id}]
+	if len(segments) > 3 && segments[3] == "presigned" {
+		PresignedUploads(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		switch len(segments) {
+		case 3: // /tenants/1/uploads
+			listUploads(w, r)
 		case 4: // /tenants/1/uploads/1
 			getUploads(w, r)
-		case 5: // /tenants/1/uploads/1/details
-			getUploadDetails(w, r)
+		case 5:
+			if segments[4] == "presigned" { // /tenants/1/uploads/1/presigned
+				getPresignedDownload(w, r)
+			} else { // /tenants/1/uploads/1/details
+				getUploadDetails(w, r)
+			}
 		default:
 			util.NotFound(&w, "path_not_found")
 			return
 		}
-	case http.MethodPost:
+	case http.MethodHead:
 		switch len(segments) {
-		case 3: // /tenants/1/uploads
+		case 4: // /tenants/1/uploads/1
+			headUploads(w, r)
+		default:
+			util.NotFound(&w, "path_not_found")
+			return
+		}
+	case http.MethodPost:
+		switch {
+		case len(segments) == 3: // /tenants/1/uploads
 			postUploads(w, r)
+		case len(segments) == 5 && segments[4] == "restore": // /tenants/1/uploads/1/restore
+			restoreUploads(w, r)
+		default:
+			util.NotFound(&w, "path_not_found")
+			return
+		}
+	case http.MethodDelete:
+		switch len(segments) {
+		case 4: // /tenants/1/uploads/1
+			deleteUploads(w, r)
 		default:
 			util.NotFound(&w, "path_not_found")
 			return
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+var (
+	pngHead  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	jpegHead = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	pdfHead  = []byte("%PDF-1.7\n")
+	textHead = []byte("<?php echo 'hello'; ?>")
+)
+
+func TestCheckDeclaredType(t *testing.T) {
+	withAppConfig(t)
+	config.App.TenantContentTypes["strict"] = []string{"image/png"}
+
+	tests := []struct {
+		name        string
+		did         string
+		fileName    string
+		contentType string
+		wantErr     bool
+	}{
+		{"nothing declared", "default", "a.png", "", false},
+		{"nothing declared, allow list without octet-stream", "strict", "a.png", "", false},
+		{"declared and extension agree", "default", "a.png", "image/png", false},
+		{"alias of an accepted type", "default", "a.jpeg", "image/jpg", false},
+		{"parameters are ignored", "default", "a.pdf", "application/pdf; version=1.7", false},
+		{"extension disagrees", "default", "a.jpg", "image/png", true},
+		{"type not accepted", "default", "a.html", "text/html", true},
+		{"type not accepted by the directory", "strict", "a.pdf", "application/pdf", true},
+		{"octet-stream leaves the type to the content", "default", "a.png", "application/octet-stream", false},
+		{"octet-stream not accepted by the directory", "strict", "a.png", "application/octet-stream", true},
+		{"unparsable type", "default", "a.png", "image/png;;", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDeclaredType(context.Background(), tt.did, tt.fileName, tt.contentType)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errContentNotAcceptable) {
+				t.Errorf("got %v, want errContentNotAcceptable", err)
+			}
+		})
+	}
+}
+
+func TestCheckUploadType(t *testing.T) {
+	withAppConfig(t)
+	config.App.TenantContentTypes["strict"] = []string{"image/png"}
+	config.App.TenantContentTypes["pdf"] = []string{"application/pdf"}
+
+	tests := []struct {
+		name        string
+		did         string
+		fileName    string
+		contentType string
+		head        []byte
+		wantErr     bool
+	}{
+		{"sniffed, extension and declared agree", "default", "a.png", "image/png", pngHead, false},
+		{"sniffed and extension agree, nothing declared", "default", "a.png", "", pngHead, false},
+		{"archive entry, allow list without octet-stream", "strict", "a.png", "", pngHead, false},
+		{"declared octet-stream", "default", "a.jpg", "application/octet-stream", jpegHead, false},
+		{"pdf", "pdf", "a.pdf", "application/pdf", pdfHead, false},
+		{"sniffed type not accepted by the directory", "pdf", "a.png", "", pngHead, true},
+		{"extension disagrees with the content", "default", "a.jpg", "", pngHead, true},
+		{"declared type disagrees with the content", "default", "a.jpg", "image/jpeg", pngHead, true},
+		{"renamed file without a signature", "default", "a.png", "", textHead, true},
+		{"script without a signature", "default", "shell.php", "", textHead, true},
+		{"no extension and no signature", "default", "README", "", textHead, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUploadType(context.Background(), tt.did, tt.fileName, tt.contentType, tt.head)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errContentNotAcceptable) {
+				t.Errorf("got %v, want errContentNotAcceptable", err)
+			}
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		meta  string
+		want  string
+	}{
+		{"no name", "", "", "inline"},
+		{"no name, download", "download=1", "", "attachment"},
+		{"ascii", "", url.QueryEscape("report.pdf"), `inline; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{"download", "download=true", url.QueryEscape("report.pdf"), `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{"other download values stay inline", "download=0", url.QueryEscape("a.pdf"), `inline; filename="a.pdf"; filename*=UTF-8''a.pdf`},
+		{"space", "", url.QueryEscape("my file.pdf"), `inline; filename="my file.pdf"; filename*=UTF-8''my%20file.pdf`},
+		{"non-ascii", "", url.QueryEscape("résumé.pdf"), `inline; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"quote and backslash", "", url.QueryEscape(`a"b\c.pdf`), `inline; filename="a_b_c.pdf"; filename*=UTF-8''a%22b%5Cc.pdf`},
+		{"control character", "", url.QueryEscape("a\nb.pdf"), `inline; filename="a_b.pdf"; filename*=UTF-8''a%0Ab.pdf`},
+		{"not query escaped", "", "100%.pdf", `inline; filename="100%.pdf"; filename*=UTF-8''100%25.pdf`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/tenants/1/uploads/x?"+tt.query, nil)
+			info := storage.ObjectInfo{Metadata: map[string]string{}}
+			if tt.meta != "" {
+				info.Metadata["name"] = tt.meta
+			}
+			if got := contentDisposition(r, info); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 10, 30, 0, 500, time.UTC)
+	tests := []struct {
+		name    string
+		etag    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no conditions", "abc", nil, false},
+		{"strong match", "abc", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"weak match", "abc", map[string]string{"If-None-Match": `W/"abc"`}, true},
+		{"match in a list", "abc", map[string]string{"If-None-Match": `"x", "abc"`}, true},
+		{"any", "abc", map[string]string{"If-None-Match": "*"}, true},
+		{"no match", "abc", map[string]string{"If-None-Match": `"x"`}, false},
+		{"If-None-Match wins over If-Modified-Since", "abc", map[string]string{
+			"If-None-Match":     `"x"`,
+			"If-Modified-Since": modified.Add(time.Hour).Format(http.TimeFormat),
+		}, false},
+		{"not modified since", "abc", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, true},
+		{"modified since", "abc", map[string]string{"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"invalid date", "abc", map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"no ETag falls back to the date", "", map[string]string{
+			"If-None-Match":     "*",
+			"If-Modified-Since": modified.Format(http.TimeFormat),
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := notModified(r, tt.etag, modified); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUploadsRange(t *testing.T) {
+	withAppConfig(t)
+	newTestDB(t)
+	_, target := newTestStores(t)
+
+	content := "0123456789"
+	putObject(t, target, "ns-01/plain.txt", content, storage.PutOptions{ContentType: "text/plain"})
+	compressed, err := io.ReadAll(mustCompress(t, content, "gzip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	putObject(t, target, "ns-01/packed.txt", string(compressed), storage.PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{metaEncoding: "gzip", metaDecodedLength: "10"},
+	})
+
+	tests := []struct {
+		name           string
+		key            string
+		headers        map[string]string
+		wantStatus     int
+		wantBody       string
+		wantRanges     string
+		wantContentLen string
+	}{
+		{"whole object", "plain.txt", nil, http.StatusOK, content, "bytes", "10"},
+		{"range", "plain.txt", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234", "bytes", "3"},
+		{"suffix range", "plain.txt", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789", "bytes", "3"},
+		{"unsatisfiable range", "plain.txt", map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "", "", ""},
+		{"decompressed content is sent whole", "packed.txt", map[string]string{"Range": "bytes=2-4"}, http.StatusOK, content, "none", "10"},
+		{"compressed content is ranged as stored", "packed.txt", map[string]string{"Range": "bytes=0-0", "Accept-Encoding": "gzip"},
+			http.StatusPartialContent, string(compressed[:1]), "bytes", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/tenants/ns:01/uploads/"+tt.key, nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			getUploads(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if got := w.Header().Get("Accept-Ranges"); got != tt.wantRanges {
+				t.Errorf("Accept-Ranges %q, want %q", got, tt.wantRanges)
+			}
+			if got := w.Header().Get("Content-Length"); tt.wantContentLen != "" && got != tt.wantContentLen {
+				t.Errorf("Content-Length %q, want %q", got, tt.wantContentLen)
+			}
+		})
+	}
+}
+
+func mustCompress(t *testing.T, content, encoding string) io.Reader {
+	t.Helper()
+	r, err := newCompressReader(strings.NewReader(content), encoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
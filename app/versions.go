@@ -0,0 +1,232 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/MidhunRajeevan/s3-migration/config"
+	"github.com/MidhunRajeevan/s3-migration/storage"
+)
+
+// versionResult counts what replaying the history of one object did
+type versionResult struct {
+	// Replayed versions were written to the target by this call
+	Replayed int64
+	// Skipped versions were already in the version mapping
+	Skipped int64
+	Bytes   int64
+}
+
+// versionedStores returns the source and target when both keep versions
+func versionedStores() (storage.VersionedStore, storage.VersionedStore, error) {
+	source, ok := config.SourceStore.(storage.VersionedStore)
+	if !ok {
+		return nil, nil, errors.New("source backend does not keep versions")
+	}
+	target, ok := config.TargetStore.(storage.VersionedStore)
+	if !ok || !config.Target.Versioning {
+		return nil, nil, errors.New("versioning is not enabled on the target bucket")
+	}
+	return source, target, nil
+}
+
+// migrateVersionsInDirectory replays the full history of every object under
+// the directory prefix. Versions of one key are replayed in order by a single
+// worker; stats count versions rather than objects.
+func migrateVersionsInDirectory(ctx context.Context, directory string) (DirectoryStats, error) {
+	objectCh := config.SourceStore.List(ctx, storage.ListOptions{
+		Prefix:    directory,
+		Recursive: true,
+		Versions:  true,
+	})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var stats DirectoryStats
+	replay := func(versions []storage.ObjectInfo) {
+		mu.Lock()
+		stats.TotalFiles += int64(len(versions))
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ctx.Err() != nil {
+				return
+			}
+			objCtx := withLogger(ctx, slog.String("key", versions[0].Key))
+			result, err := migrateObjectVersions(objCtx, directory, versions)
+
+			mu.Lock()
+			stats.MigratedFiles += result.Replayed + result.Skipped
+			stats.Bytes += result.Bytes
+			if err != nil {
+				stats.FailedFiles += int64(len(versions)) - result.Replayed - result.Skipped
+			}
+			mu.Unlock()
+
+			if err != nil {
+				logFailedFile(objCtx, directory, versions[0].Key, err)
+				return
+			}
+			logger(objCtx).Info("Versions migrated",
+				slog.Int64("replayed", result.Replayed),
+				slog.Int64("skipped", result.Skipped),
+				slog.Int64("bytes", result.Bytes))
+		}()
+	}
+
+	// The listing yields the versions of a key together, oldest first
+	var versions []storage.ObjectInfo
+	for {
+		select {
+		case object, ok := <-objectCh:
+			if !ok {
+				if len(versions) > 0 {
+					replay(versions)
+				}
+				wg.Wait()
+				return stats, nil
+			}
+			if object.Err != nil {
+				wg.Wait()
+				return stats, object.Err
+			}
+			if len(versions) > 0 && versions[0].Key != object.Key {
+				replay(versions)
+				versions = nil
+			}
+			versions = append(versions, object)
+		case <-ctx.Done():
+			wg.Wait()
+			return stats, ctx.Err()
+		}
+	}
+}
+
+// retryObjectVersions replays the versions of one key that are not in the
+// version mapping yet
+func retryObjectVersions(ctx context.Context, did, objectKey string) (versionResult, error) {
+	var versions []storage.ObjectInfo
+	for object := range config.SourceStore.List(ctx, storage.ListOptions{Prefix: objectKey, Versions: true}) {
+		if object.Err != nil {
+			return versionResult{}, object.Err
+		}
+		if object.Key == objectKey {
+			versions = append(versions, object)
+		}
+	}
+	if len(versions) == 0 {
+		return versionResult{}, fmt.Errorf("no versions of %s on source: %w", objectKey, storage.ErrNotFound)
+	}
+	return migrateObjectVersions(ctx, did, versions)
+}
+
+// migrateObjectVersions replays the versions of one key, oldest first.
+// Versions already in the mapping are skipped, so an interrupted history
+// resumes where it stopped. Replay stops at the first version that fails, as
+// later versions would land on the target out of order.
+func migrateObjectVersions(ctx context.Context, did string, versions []storage.ObjectInfo) (versionResult, error) {
+	var result versionResult
+	var targetKey string
+	for _, version := range versions {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		mapped, err := SelectVersionMapping(version.Key, version.VersionID)
+		if err == nil {
+			targetKey = mapped
+			result.Skipped++
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return result, fmt.Errorf("failed to read version mapping: %w", err)
+		}
+
+		previousKey := targetKey
+		size, err := withRetry(ctx, func() (int64, error) {
+			var size int64
+			var err error
+			targetKey, size, err = migrateVersion(ctx, did, version, previousKey)
+			return size, err
+		})
+		if err != nil {
+			return result, fmt.Errorf("version %s: %w", version.VersionID, err)
+		}
+		result.Replayed++
+		result.Bytes += size
+	}
+	return result, nil
+}
+
+// migrateVersion writes one source version to the target as a new version
+// and records the mapping. A delete marker is replayed on previousKey, the
+// key the preceding version went to, or on its own key when it opens the
+// history. Dedup does not apply, each version is stored in full.
+func migrateVersion(ctx context.Context, did string, version storage.ObjectInfo, previousKey string) (string, int64, error) {
+	source, target, err := versionedStores()
+	if err != nil {
+		return "", 0, err
+	}
+	// A half replayed version would be written again on resume, so a stop
+	// request lets the current one finish
+	ctx = context.WithoutCancel(ctx)
+
+	if version.IsDeleteMarker {
+		targetKey := previousKey
+		if targetKey == "" {
+			targetKey = version.Key
+		}
+		versionID, err := target.PutDeleteMarker(ctx, targetKey)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to put delete marker on target: %w", err)
+		}
+		if err = RecordVersionMapping(jobID(ctx), version.Key, version.VersionID, targetKey, versionID, true); err != nil {
+			return "", 0, fmt.Errorf("failed to record version mapping: %w", err)
+		}
+		return targetKey, 0, nil
+	}
+
+	object, objInfo, err := source.GetVersion(ctx, version.Key, version.VersionID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get version from source: %w", err)
+	}
+	defer object.Close()
+
+	targetKey, err := rewriteKey(ctx, objInfo)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to rewrite key: %w", err)
+	}
+
+	if !objInfo.Retention.IsZero() && !config.Target.ObjectLock {
+		return "", 0, fmt.Errorf("%w: object lock is not enabled on the target bucket", errRetentionNotPreserved)
+	}
+
+	body, size, metadata, err := encodeObject(did, objInfo.ContentType, object, objInfo.Size, objInfo.Metadata)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encode object: %w", err)
+	}
+	written, err := target.Put(ctx, targetKey, body, size, targetPutOptions(did, objInfo, metadata))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to put object to target: %w", err)
+	}
+	if err = verifyObject(ctx, targetKey, objInfo, false); err != nil {
+		return "", 0, err
+	}
+
+	if err = RecordVersionMapping(jobID(ctx), version.Key, version.VersionID, targetKey, written.VersionID, false); err != nil {
+		return "", 0, fmt.Errorf("failed to record version mapping: %w", err)
+	}
+	if targetKey != version.Key {
+		if err = RecordKeyMapping(version.Key, targetKey); err != nil {
+			return "", 0, fmt.Errorf("failed to record key mapping: %w", err)
+		}
+	}
+
+	return targetKey, objInfo.Size, nil
+}
@@ -1,17 +1,34 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type appConfig struct {
-	TenantString  string
-	UploadLimit   int64
-	ContentTypes  []string
-	ListenPort    int
-	AllowInsecure bool
+	TenantString string
+	UploadLimit  int64
+	ArchiveLimit int64
+	ContentTypes []string
+	// TenantContentTypes replace ContentTypes for the directories listed
+	TenantContentTypes map[string][]string
+	ListenPort         int
+	AllowInsecure      bool
+	Retries            int
+	Dedup              bool
+	Compression        map[string]string
+	Versions           bool
+	Move               bool
+	MoveGrace          time.Duration
+	MoveLimit          int
+	PresignExpiry      time.Duration
+	CacheControl       string
+	RestoreWindow      time.Duration
+	SessionExpiry      time.Duration
+	AdminToken         string
 }
 
 // App configuration from environment
@@ -21,13 +38,35 @@ const (
 	appListenPort    = "APP_LISTEN_PORT"
 	appTenantString  = "APP_TENANT_STRING"
 	appUploadLimit   = "APP_UPLOAD_LIMIT"
+	appArchiveLimit  = "APP_ARCHIVE_LIMIT"
 	appAllowInsecure = "APP_ALLOW_INSECURE"
+	appRetries       = "APP_MIGRATION_RETRIES"
+	appDedup         = "APP_DEDUP"
+	appCompression   = "APP_COMPRESSION"
+	appVersions      = "APP_MIGRATE_VERSIONS"
+	appMove          = "APP_MOVE"
+	appMoveGrace     = "APP_MOVE_GRACE"
+	appMoveLimit     = "APP_MOVE_MAX_DELETIONS"
+	appPresignExpiry = "APP_PRESIGN_EXPIRY"
+	appCacheControl  = "APP_CACHE_CONTROL"
+	appRestoreWindow = "APP_RESTORE_WINDOW"
+	appSessionExpiry = "APP_SESSION_EXPIRY"
+	appAdminToken    = "APP_ADMIN_TOKEN"
+	appTenantTypes   = "APP_TENANT_CONTENT_TYPES"
 )
 
 const (
-	defaultListenPort   = 9090
-	defaultTenantString = "tenants"
-	defaultUploadLimit  = 10
+	defaultListenPort    = 9090
+	defaultTenantString  = "tenants"
+	defaultUploadLimit   = 10
+	defaultArchiveLimit  = 1 << 30
+	defaultRetries       = 3
+	defaultMoveGrace     = 24 * time.Hour
+	defaultMoveLimit     = 1000
+	defaultPresignExpiry = 15 * time.Minute
+	defaultCacheControl  = "private, no-cache"
+	defaultRestoreWindow = 7 * 24 * time.Hour
+	defaultSessionExpiry = 24 * time.Hour
 )
 
 // InitializeApp Configuration
@@ -59,8 +98,36 @@ func InitializeApp() {
 		App.UploadLimit = defaultUploadLimit
 	}
 
+	// Size of an imported archive, its entries are held to UploadLimit
+	if it, ok := os.LookupEnv(appArchiveLimit); ok {
+		if App.ArchiveLimit, err = strconv.ParseInt(it, 10, 64); err != nil || App.ArchiveLimit <= 0 {
+			App.ArchiveLimit = defaultArchiveLimit
+		}
+	} else {
+		App.ArchiveLimit = defaultArchiveLimit
+	}
+
 	App.ContentTypes = []string{"image/jpeg", "image/jpg", "image/png", "image/gif", "application/pdf", "application/octet-stream"}
 
+	// Accepted types per directory, e.g. 1=image/png|image/jpeg,2=application/pdf
+	App.TenantContentTypes = make(map[string][]string)
+	if it, ok := os.LookupEnv(appTenantTypes); ok {
+		for _, rule := range strings.Split(it, ",") {
+			if rule = strings.TrimSpace(rule); rule == "" {
+				continue
+			}
+			did, types, found := strings.Cut(rule, "=")
+			if !found || strings.TrimSpace(did) == "" || strings.TrimSpace(types) == "" {
+				panic(fmt.Sprintf("APP_TENANT_CONTENT_TYPES: invalid rule %q, expected directory=type|type", rule))
+			}
+			for _, contentType := range strings.Split(types, "|") {
+				if contentType = strings.TrimSpace(contentType); contentType != "" {
+					App.TenantContentTypes[strings.TrimSpace(did)] = append(App.TenantContentTypes[strings.TrimSpace(did)], contentType)
+				}
+			}
+		}
+	}
+
 	// Allow Insecure
 	App.AllowInsecure = false
 	insecure, ok := os.LookupEnv(appAllowInsecure)
@@ -68,4 +135,111 @@ func InitializeApp() {
 		App.AllowInsecure = true
 	}
 
+	// Attempts per object before it is recorded as failed
+	if it, ok := os.LookupEnv(appRetries); ok {
+		if App.Retries, err = strconv.Atoi(it); err != nil || App.Retries < 1 {
+			App.Retries = defaultRetries
+		}
+	} else {
+		App.Retries = defaultRetries
+	}
+
+	// Store identical content once across directories
+	App.Dedup = false
+	dedup, ok := os.LookupEnv(appDedup)
+	if ok && (strings.ToLower(dedup) == "true") {
+		App.Dedup = true
+	}
+
+	// Replay every version and delete marker instead of the latest version
+	App.Versions = false
+	versions, ok := os.LookupEnv(appVersions)
+	if ok && (strings.ToLower(versions) == "true") {
+		App.Versions = true
+	}
+
+	// Delete source objects once their copy is verified and the grace
+	// delay has passed, at most MoveLimit per job
+	App.Move = false
+	move, ok := os.LookupEnv(appMove)
+	if ok && (strings.ToLower(move) == "true") {
+		App.Move = true
+	}
+	if App.Move && App.Versions {
+		panic("APP_MOVE cannot be combined with APP_MIGRATE_VERSIONS")
+	}
+
+	if it, ok := os.LookupEnv(appMoveGrace); ok {
+		if App.MoveGrace, err = time.ParseDuration(it); err != nil || App.MoveGrace < 0 {
+			App.MoveGrace = defaultMoveGrace
+		}
+	} else {
+		App.MoveGrace = defaultMoveGrace
+	}
+
+	if it, ok := os.LookupEnv(appMoveLimit); ok {
+		if App.MoveLimit, err = strconv.Atoi(it); err != nil || App.MoveLimit < 1 {
+			App.MoveLimit = defaultMoveLimit
+		}
+	} else {
+		App.MoveLimit = defaultMoveLimit
+	}
+
+	// Lifetime of presigned upload and download URLs
+	if it, ok := os.LookupEnv(appPresignExpiry); ok {
+		if App.PresignExpiry, err = time.ParseDuration(it); err != nil || App.PresignExpiry <= 0 {
+			App.PresignExpiry = defaultPresignExpiry
+		}
+	} else {
+		App.PresignExpiry = defaultPresignExpiry
+	}
+
+	// Cache-Control of downloads; the default lets browsers keep a copy
+	// and revalidate it with the ETag
+	if it, ok := os.LookupEnv(appCacheControl); ok && it != "" {
+		App.CacheControl = it
+	} else {
+		App.CacheControl = defaultCacheControl
+	}
+
+	// Time a deleted upload can be restored before it is purged
+	if it, ok := os.LookupEnv(appRestoreWindow); ok {
+		if App.RestoreWindow, err = time.ParseDuration(it); err != nil || App.RestoreWindow < 0 {
+			App.RestoreWindow = defaultRestoreWindow
+		}
+	} else {
+		App.RestoreWindow = defaultRestoreWindow
+	}
+
+	// Time an upload session may sit idle before it is expired and its
+	// temporary upload removed, never shorter than a presigned URL lives
+	if it, ok := os.LookupEnv(appSessionExpiry); ok {
+		if App.SessionExpiry, err = time.ParseDuration(it); err != nil || App.SessionExpiry <= 0 {
+			App.SessionExpiry = defaultSessionExpiry
+		}
+	} else {
+		App.SessionExpiry = defaultSessionExpiry
+	}
+	if App.SessionExpiry < App.PresignExpiry {
+		App.SessionExpiry = App.PresignExpiry
+	}
+
+	// Bearer token allowed to delete and restore uploads, to import and
+	// export archives and to retry, roll back and report jobs, none when unset
+	App.AdminToken = os.Getenv(appAdminToken)
+
+	// Encoding per content type, e.g. application/pdf=gzip,application/octet-stream=zstd
+	App.Compression = make(map[string]string)
+	if it, ok := os.LookupEnv(appCompression); ok {
+		for _, rule := range strings.Split(it, ",") {
+			if rule = strings.TrimSpace(rule); rule == "" {
+				continue
+			}
+			contentType, encoding, found := strings.Cut(rule, "=")
+			if !found || (encoding != "gzip" && encoding != "zstd") {
+				panic(fmt.Sprintf("APP_COMPRESSION: invalid rule %q, expected content/type=gzip|zstd", rule))
+			}
+			App.Compression[strings.TrimSpace(contentType)] = encoding
+		}
+	}
 }
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type cseConfig struct {
+	Key         []byte
+	Directories []string
+}
+
+// CSE client-side encryption configuration
+var CSE cseConfig
+
+const (
+	appCSEKeyFile     = "APP_CSE_KEY_FILE"
+	appCSEDirectories = "APP_CSE_DIRECTORIES"
+)
+
+// InitializeCSE loads the master key that wraps per-object data keys. Without
+// APP_CSE_KEY_FILE nothing is encrypted client-side; APP_CSE_DIRECTORIES
+// limits encryption to a comma separated list of directories.
+func InitializeCSE() {
+	file, ok := os.LookupEnv(appCSEKeyFile)
+	if !ok || file == "" {
+		return
+	}
+
+	key, err := readKeyFile(file, 32)
+	if err != nil {
+		panic(fmt.Sprintf("APP_CSE_KEY_FILE: %v", err))
+	}
+	CSE.Key = key
+
+	if it, ok := os.LookupEnv(appCSEDirectories); ok {
+		for _, dir := range strings.Split(it, ",") {
+			if dir = strings.TrimSpace(dir); dir != "" {
+				CSE.Directories = append(CSE.Directories, dir)
+			}
+		}
+	}
+
+	Logger.Info("Client-side encryption enabled", slog.Any("directories", CSE.Directories))
+}
+
+// Encrypts reports whether objects of a directory are encrypted client-side
+func (c cseConfig) Encrypts(did string) bool {
+	if c.Key == nil {
+		return false
+	}
+	if len(c.Directories) == 0 {
+		return true
+	}
+	for _, dir := range c.Directories {
+		if dir == did {
+			return true
+		}
+	}
+	return false
+}
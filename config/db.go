@@ -3,7 +3,6 @@ package config
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"os"
 
 	_ "github.com/lib/pq"
@@ -71,7 +70,7 @@ func InitializeDB() {
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Database config established.")
+	Logger.Info("Database config established.")
 
 	// Setup database object if not exists
 	Setup()
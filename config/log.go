@@ -0,0 +1,25 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Logger writes structured JSON records to stdout
+var Logger *slog.Logger
+
+const appLogLevel = "APP_LOG_LEVEL"
+
+// InitializeLogger configures the JSON logger and makes it the default, so
+// the standard log package is routed through it too.
+func InitializeLogger() {
+	level := slog.LevelInfo
+	if it, ok := os.LookupEnv(appLogLevel); ok {
+		if err := level.UnmarshalText([]byte(it)); err != nil {
+			level = slog.LevelInfo
+		}
+	}
+
+	Logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(Logger)
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"text/template"
+)
+
+// RewriteRule maps a source key to a new target key. Type selects how:
+//
+//	prefix:   keys starting with Match get it replaced by Replace
+//	regex:    keys matching Match are rewritten with Replace ($1 etc.)
+//	template: keys matching Match (or all keys) are rendered from Template
+type RewriteRule struct {
+	Type     string `json:"type"`
+	Match    string `json:"match"`
+	Replace  string `json:"replace"`
+	Template string `json:"template"`
+
+	Pattern *regexp.Regexp     `json:"-"`
+	Tmpl    *template.Template `json:"-"`
+}
+
+// RewriteRules applied in order, the first matching rule wins
+var RewriteRules []RewriteRule
+
+const appRewriteRules = "APP_REWRITE_RULES"
+
+// InitializeRewrite loads the key rewrite rules from the JSON file named by
+// APP_REWRITE_RULES. Without it keys are migrated unchanged.
+func InitializeRewrite() {
+	file, ok := os.LookupEnv(appRewriteRules)
+	if !ok {
+		return
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		panic(fmt.Sprintf("APP_REWRITE_RULES file cannot be read: %v", err))
+	}
+	if err = json.Unmarshal(b, &RewriteRules); err != nil {
+		panic(fmt.Sprintf("APP_REWRITE_RULES file is not valid JSON: %v", err))
+	}
+
+	for i := range RewriteRules {
+		rule := &RewriteRules[i]
+		switch rule.Type {
+		case "prefix":
+			if rule.Match == "" {
+				panic(fmt.Sprintf("rewrite rule %d: prefix rule requires match", i))
+			}
+		case "regex", "template":
+			if rule.Match != "" {
+				if rule.Pattern, err = regexp.Compile(rule.Match); err != nil {
+					panic(fmt.Sprintf("rewrite rule %d: %v", i, err))
+				}
+			} else if rule.Type == "regex" {
+				panic(fmt.Sprintf("rewrite rule %d: regex rule requires match", i))
+			}
+			if rule.Type == "template" {
+				if rule.Tmpl, err = template.New(fmt.Sprintf("rule%d", i)).Option("missingkey=error").Parse(rule.Template); err != nil {
+					panic(fmt.Sprintf("rewrite rule %d: %v", i, err))
+				}
+			}
+		default:
+			panic(fmt.Sprintf("rewrite rule %d: type must be one of prefix, regex, template", i))
+		}
+	}
+
+	Logger.Info("Rewrite rules loaded", slog.Int("rules", len(RewriteRules)))
+}
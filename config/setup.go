@@ -1,7 +1,7 @@
 package config
 
 import (
-	"log"
+	"log/slog"
 )
 
 func createDirectory() error {
@@ -15,19 +15,358 @@ func createDirectory() error {
 			completed_at  timestamptz
 		)`
 	if _, err := DB.Exec(statement); err != nil {
-		log.Println(err)
+		Logger.Error("Database setup failed", slog.Any("error", err))
 		panic("Create table DIRECTORY failed!")
 	}
 
 	if _, err := DB.Exec(statement); err != nil {
-		log.Println(err)
+		Logger.Error("Database setup failed", slog.Any("error", err))
 		panic("Create index on directory failed!")
 	}
 
+	statement = `
+		alter table directory
+			add column if not exists migrated_files  int not null default 0,
+			add column if not exists failed_files    int not null default 0,
+			add column if not exists bytes           bigint not null default 0`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table DIRECTORY failed!")
+	}
+
+	return nil
+}
+
+func createFailedObject() error {
+	statement := `
+		create table if not exists failed_object (
+			id             bigserial primary key,
+			did            text not null,
+			object_key     text not null,
+			error_code     text not null,
+			error_message  text not null,
+			attempts       int not null default 1,
+			status         text not null default 'failed',
+			failed_at      timestamptz not null default now(),
+			updated_at     timestamptz not null default now()
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table FAILED_OBJECT failed!")
+	}
+
+	statement = `
+		create index if not exists failed_object_did_status_idx
+		on failed_object (did, status)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create index on failed_object failed!")
+	}
+
+	return nil
+}
+
+func createJob() error {
+	statement := `
+		create table if not exists job (
+			id            bigserial primary key,
+			kind          text not null,
+			status        text not null default 'running',
+			started_at    timestamptz not null default now(),
+			completed_at  timestamptz
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table JOB failed!")
+	}
+
+	statement = `
+		alter table directory add column if not exists job_id bigint references job (id)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table DIRECTORY failed!")
+	}
+
+	statement = `
+		alter table failed_object add column if not exists job_id bigint references job (id)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table FAILED_OBJECT failed!")
+	}
+
+	// Rollback jobs copy from the target back to the source
+	statement = `
+		alter table job add column if not exists direction text not null default 'forward'`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table JOB failed!")
+	}
+
+	statement = `
+		alter table failed_object add column if not exists direction text not null default 'forward'`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table FAILED_OBJECT failed!")
+	}
+
+	// A key can fail both ways, each failure is retried in its direction
+	statement = `
+		alter table failed_object drop constraint if exists failed_object_object_key_key`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table FAILED_OBJECT failed!")
+	}
+
+	statement = `
+		create unique index if not exists failed_object_key_direction_idx
+		on failed_object (object_key, direction)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create index on failed_object failed!")
+	}
+
+	return nil
+}
+
+func createKeyMapping() error {
+	statement := `
+		create table if not exists key_mapping (
+			source_key  text primary key,
+			target_key  text not null,
+			created_at  timestamptz not null default now()
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table KEY_MAPPING failed!")
+	}
+
+	return nil
+}
+
+func createBlob() error {
+	statement := `
+		create table if not exists blob (
+			hash        text primary key,
+			object_key  text not null unique,
+			size        bigint not null,
+			ref_count   int not null default 0,
+			created_at  timestamptz not null default now()
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table BLOB failed!")
+	}
+
+	statement = `
+		create table if not exists blob_ref (
+			object_key  text primary key,
+			did         text not null,
+			hash        text not null references blob (hash),
+			created_at  timestamptz not null default now()
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table BLOB_REF failed!")
+	}
+
+	statement = `
+		create index if not exists blob_ref_did_idx on blob_ref (did)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create index on blob_ref failed!")
+	}
+
+	statement = `
+		alter table blob_ref
+			add column if not exists name  text not null default '',
+			add column if not exists url   text not null default ''`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table BLOB_REF failed!")
+	}
+
+	return nil
+}
+
+func createObjectVersion() error {
+	statement := `
+		create table if not exists object_version (
+			source_key         text not null,
+			source_version_id  text not null,
+			target_key         text not null,
+			target_version_id  text not null,
+			delete_marker      boolean not null default false,
+			job_id             bigint references job (id),
+			created_at         timestamptz not null default now(),
+			primary key (source_key, source_version_id)
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table OBJECT_VERSION failed!")
+	}
+
+	return nil
+}
+
+func createDeletionJournal() error {
+	statement := `
+		create table if not exists deletion_journal (
+			id            bigserial primary key,
+			job_id        bigint references job (id),
+			did           text not null,
+			source_key    text not null unique,
+			source_etag   text not null,
+			target_key    text not null,
+			status        text not null default 'pending',
+			message       text not null default '',
+			delete_after  timestamptz not null,
+			deleted_at    timestamptz,
+			created_at    timestamptz not null default now()
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table DELETION_JOURNAL failed!")
+	}
+
+	statement = `
+		create index if not exists deletion_journal_status_idx
+		on deletion_journal (status, delete_after)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create index on deletion_journal failed!")
+	}
+
+	return nil
+}
+
+func createUploadSession() error {
+	statement := `
+		create table if not exists upload_session (
+			id            text primary key,
+			did           text not null,
+			tenant        text not null,
+			file_name     text not null,
+			content_type  text not null,
+			object_key    text not null,
+			upload_id     text not null,
+			length        bigint not null,
+			"offset"      bigint not null default 0,
+			hash_state    bytea,
+			status        text not null default 'open',
+			created_at    timestamptz not null default now(),
+			updated_at    timestamptz not null default now()
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table UPLOAD_SESSION failed!")
+	}
+
+	statement = `
+		create table if not exists upload_part (
+			session_id   text not null references upload_session (id) on delete cascade,
+			part_number  int not null,
+			etag         text not null,
+			size         bigint not null,
+			primary key (session_id, part_number)
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table UPLOAD_PART failed!")
+	}
+
+	// Presigned uploads are sent by the client straight to the bucket
+	statement = `
+		alter table upload_session add column if not exists kind text not null default 'multipart'`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table UPLOAD_SESSION failed!")
+	}
+
+	// Part numbers are reserved before a chunk is sent, so concurrent
+	// chunks never share one
+	statement = `
+		alter table upload_session add column if not exists next_part int not null default 0`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Alter table UPLOAD_SESSION failed!")
+	}
+
+	return nil
+}
+
+func createUploadDeletion() error {
+	statement := `
+		create table if not exists upload_deletion (
+			id           bigserial primary key,
+			did          text not null,
+			object_key   text not null,
+			status       text not null default 'deleted',
+			message      text not null default '',
+			purge_after  timestamptz not null,
+			deleted_at   timestamptz not null default now(),
+			restored_at  timestamptz,
+			purged_at    timestamptz
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table UPLOAD_DELETION failed!")
+	}
+
+	// An upload has at most one pending deletion
+	statement = `
+		create unique index if not exists upload_deletion_key_idx
+		on upload_deletion (object_key) where status = 'deleted'`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create index on upload_deletion failed!")
+	}
+
+	statement = `
+		create index if not exists upload_deletion_status_idx
+		on upload_deletion (status, purge_after)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create index on upload_deletion failed!")
+	}
+
+	return nil
+}
+
+func createDirectoryRollback() error {
+	// Rollbacks are kept apart so the forward run of a directory stays in
+	// the report of its job
+	statement := `
+		create table if not exists directory_rollback (
+			id              bigserial primary key,
+			job_id          bigint not null references job (id),
+			did             text not null,
+			total_files     int not null default 0,
+			migrated_files  int not null default 0,
+			failed_files    int not null default 0,
+			bytes           bigint not null default 0,
+			status          text not null default 'rollback_in_progress',
+			started_at      timestamptz not null default now(),
+			completed_at    timestamptz,
+			unique (job_id, did)
+		)`
+	if _, err := DB.Exec(statement); err != nil {
+		Logger.Error("Database setup failed", slog.Any("error", err))
+		panic("Create table DIRECTORY_ROLLBACK failed!")
+	}
+
 	return nil
 }
 
 // Setup database
 func Setup() {
 	createDirectory()
+	createFailedObject()
+	createJob()
+	createKeyMapping()
+	createBlob()
+	createObjectVersion()
+	createDeletionJournal()
+	createUploadSession()
+	createUploadDeletion()
+	createDirectoryRollback()
 }
@@ -3,16 +3,20 @@ package config
 import (
 	"context"
 	"crypto/tls"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/MidhunRajeevan/s3-migration/storage"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 type sourceS3Config struct {
+	Backend       string
+	Root          string
+	AzureConnStr  string
 	Location      string
 	Endpoint      string
 	Bucket        string
@@ -20,6 +24,7 @@ type sourceS3Config struct {
 	SecretKey     string
 	UseSSL        bool
 	AllowInsecure bool
+	ObjectLock    bool
 }
 
 var Source sourceS3Config
@@ -32,16 +37,49 @@ const (
 	sourceSecretKey     = "S3_SOURCE_SECRET_KEY"
 	sourceUseSSL        = "S3_SOURCE_USE_SSL"
 	sourceAllowInsecure = "S3_SOURCE_ALLOW_INSECURE"
+	sourceBackend       = "SOURCE_BACKEND"
+	sourceRoot          = "SOURCE_ROOT"
+	sourceAzureConnStr  = "SOURCE_AZURE_CONNECTION_STRING"
+	sourceAzureBucket   = "SOURCE_AZURE_CONTAINER"
 )
 
 // sourceClient for uploads
 var SourceClient *minio.Client
 
+// SourceStore used by the migration engine. It wraps SourceClient unless
+// SOURCE_BACKEND selects another backend.
+var SourceStore storage.ObjectStore
+
 // Initializesource connection
 func Initializesource() {
 	var err error
 	var ok bool
 
+	Source.Backend, ok = os.LookupEnv(sourceBackend)
+	if !ok {
+		Source.Backend = "s3"
+	}
+
+	switch Source.Backend {
+	case "fs":
+		Source.Root, ok = os.LookupEnv(sourceRoot)
+		if !ok {
+			panic("SOURCE_ROOT environment variable required but not set")
+		}
+		if SourceStore, err = storage.NewFSStore(Source.Root); err != nil {
+			Logger.Error("Source Root Error", slog.String("root", Source.Root), slog.Any("error", err))
+			os.Exit(1)
+		}
+		Logger.Info("Source Configuration Complete", slog.String("root", Source.Root))
+		return
+	case "azure":
+		initializeAzureSource()
+		return
+	case "s3":
+	default:
+		panic("SOURCE_BACKEND must be one of s3, fs, azure")
+	}
+
 	Source.Location, ok = os.LookupEnv(sourceEndpoint)
 	if !ok {
 		Source.Location = "us-east-1"
@@ -87,29 +125,75 @@ func Initializesource() {
 	}
 
 	// Initialize minio client object.
-	log.Println("Connecting to source")
+	logger := Logger.With(slog.String("endpoint", Source.Endpoint), slog.String("bucket", Source.Bucket))
+	logger.Info("Connecting to source")
 	SourceClient, err = minio.New(Source.Endpoint, &minio.Options{
 		Creds:     credentials.NewStaticV4(Source.AccessKey, Source.SecretKey, ""),
 		Secure:    Source.UseSSL,
 		Transport: transport,
 	})
 	if err != nil {
-		log.Println("source Client Error")
-		log.Printf("%v\n", Source)
-		log.Fatalln(err)
+		logger.Error("source Client Error", slog.Any("error", err))
+		os.Exit(1)
 	}
 
 	// Check bucket
-	log.Println("Checking Bucket Exists")
+	logger.Info("Checking Bucket Exists")
 	found, err := SourceClient.BucketExists(context.Background(), Source.Bucket)
 	if err != nil {
 		errResponse := minio.ToErrorResponse(err)
-		log.Println("source Bucket Error")
-		log.Println(errResponse)
-		log.Fatalln(err)
+		logger.Error("source Bucket Error", slog.String("error_code", errResponse.Code), slog.Any("error", err))
+		os.Exit(1)
 	} else if !found {
-		log.Fatalln("Bucket does not exist!")
+		logger.Error("Bucket does not exist!")
+		os.Exit(1)
+	}
+
+	// Retention can only be restored by a rollback into a bucket with
+	// object lock
+	lock, _, _, _, err := SourceClient.GetObjectLockConfig(context.Background(), Source.Bucket)
+	if err != nil && minio.ToErrorResponse(err).Code != "ObjectLockConfigurationNotFoundError" {
+		logger.Error("S3 Object Lock Error", slog.Any("error", err))
+		os.Exit(1)
+	}
+	Source.ObjectLock = lock == "Enabled"
+
+	minioStore := storage.NewMinioStore(SourceClient, Source.Bucket)
+	minioStore.Encryption, _ = serverSideEncryption("SOURCE")
+	SourceStore = minioStore
+	logger.Info("source Configuration Complete")
+}
+
+// initializeAzureSource reads from an Azure Blob Storage container, or from
+// Azurite when the connection string points at the emulator
+func initializeAzureSource() {
+	var err error
+	var ok bool
+
+	Source.AzureConnStr, ok = os.LookupEnv(sourceAzureConnStr)
+	if !ok {
+		panic("SOURCE_AZURE_CONNECTION_STRING environment variable required but not set")
+	}
+
+	Source.Bucket, ok = os.LookupEnv(sourceAzureBucket)
+	if !ok {
+		panic("SOURCE_AZURE_CONTAINER environment variable required but not set")
+	}
+
+	logger := Logger.With(slog.String("container", Source.Bucket))
+	logger.Info("Connecting to Azure source")
+	store, err := storage.NewAzureStore(Source.AzureConnStr, Source.Bucket)
+	if err != nil {
+		logger.Error("Azure Client Error", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// Check container
+	if _, err = store.Client.GetProperties(context.Background(), nil); err != nil {
+		logger.Error("Azure Container Error", slog.Any("error", err))
+		os.Exit(1)
 	}
 
-	log.Println("source Configuration Complete")
+	SourceStore = store
+	logger.Info("Azure source Configuration Complete")
 }
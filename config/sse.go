@@ -0,0 +1,75 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// serverSideEncryption reads <prefix>_SSE (none, s3, kms or c) with its key
+// settings and returns the encryption to apply, or nil for none, and a
+// description naming the mode and key, empty for none:
+//
+//	<prefix>_SSE_KMS_KEY_ID  KMS key for kms
+//	<prefix>_SSE_C_KEY_FILE  file with the 32 byte customer key, raw or
+//	                         base64 encoded, for c
+func serverSideEncryption(prefix string) (encrypt.ServerSide, string) {
+	mode, ok := os.LookupEnv(prefix + "_SSE")
+	if !ok {
+		return nil, ""
+	}
+
+	switch strings.ToLower(mode) {
+	case "", "none":
+		return nil, ""
+	case "s3":
+		return encrypt.NewSSE(), "s3"
+	case "kms":
+		keyID, ok := os.LookupEnv(prefix + "_SSE_KMS_KEY_ID")
+		if !ok {
+			panic(prefix + "_SSE_KMS_KEY_ID environment variable required but not set")
+		}
+		sse, err := encrypt.NewSSEKMS(keyID, nil)
+		if err != nil {
+			panic(fmt.Sprintf("%s_SSE_KMS_KEY_ID is invalid: %v", prefix, err))
+		}
+		return sse, "kms:" + keyID
+	case "c":
+		file, ok := os.LookupEnv(prefix + "_SSE_C_KEY_FILE")
+		if !ok {
+			panic(prefix + "_SSE_C_KEY_FILE environment variable required but not set")
+		}
+		key, err := readKeyFile(file, 32)
+		if err != nil {
+			panic(fmt.Sprintf("%s_SSE_C_KEY_FILE: %v", prefix, err))
+		}
+		sse, err := encrypt.NewSSEC(key)
+		if err != nil {
+			panic(fmt.Sprintf("%s_SSE_C_KEY_FILE: %v", prefix, err))
+		}
+		// The key itself must not end up in the database
+		return sse, fmt.Sprintf("c:%x", sha256.Sum256(key))[:18]
+	default:
+		panic(prefix + "_SSE must be one of none, s3, kms, c")
+	}
+}
+
+// readKeyFile loads a key of the given length stored raw or base64 encoded
+func readKeyFile(file string, length int) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == length {
+		return b, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != length {
+		return nil, fmt.Errorf("key must be %d bytes, raw or base64 encoded", length)
+	}
+	return key, nil
+}
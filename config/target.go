@@ -3,16 +3,19 @@ package config
 import (
 	"context"
 	"crypto/tls"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/MidhunRajeevan/s3-migration/storage"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 type targets3Config struct {
+	Backend       string
+	Root          string
 	Location      string
 	Endpoint      string
 	Bucket        string
@@ -20,6 +23,9 @@ type targets3Config struct {
 	SecretKey     string
 	UseSSL        bool
 	AllowInsecure bool
+	ObjectLock    bool
+	Versioning    bool
+	SSE           string
 }
 
 // S3 Configuration
@@ -33,16 +39,42 @@ const (
 	s3SecretKey     = "S3_TARGET_SECRET_KEY"
 	s3UseSSL        = "S3_TARGET_USE_SSL"
 	s3AllowInsecure = "S3_TARGET_ALLOW_INSECURE"
+	s3Backend       = "TARGET_BACKEND"
+	s3Root          = "TARGET_ROOT"
 )
 
 // S3Client for uploads
 var TargetClient *minio.Client
 
+// TargetStore used by the migration engine. It wraps TargetClient unless
+// TARGET_BACKEND selects another backend.
+var TargetStore storage.ObjectStore
+
 // InitializeS3 connection
 func InitializeTarget() {
 	var err error
 	var ok bool
 
+	Target.Backend, ok = os.LookupEnv(s3Backend)
+	if !ok {
+		Target.Backend = "s3"
+	}
+
+	if Target.Backend == "fs" {
+		Target.Root, ok = os.LookupEnv(s3Root)
+		if !ok {
+			panic("TARGET_ROOT environment variable required but not set")
+		}
+		if TargetStore, err = storage.NewFSStore(Target.Root); err != nil {
+			Logger.Error("Target Root Error", slog.String("root", Target.Root), slog.Any("error", err))
+			os.Exit(1)
+		}
+		Logger.Info("Target Configuration Complete", slog.String("root", Target.Root))
+		return
+	} else if Target.Backend != "s3" {
+		panic("TARGET_BACKEND must be one of s3, fs")
+	}
+
 	Target.Location, ok = os.LookupEnv(s3Endpoint)
 	if !ok {
 		Target.Location = "us-east-1"
@@ -88,30 +120,52 @@ func InitializeTarget() {
 	}
 
 	// Initialize minio client object.
-	log.Println("Connecting to S3")
+	logger := Logger.With(slog.String("endpoint", Target.Endpoint), slog.String("bucket", Target.Bucket))
+	logger.Info("Connecting to S3")
 	TargetClient, err = minio.New(Target.Endpoint, &minio.Options{
 		Creds:     credentials.NewStaticV4(Target.AccessKey, Target.SecretKey, ""),
 		Secure:    Target.UseSSL,
 		Transport: transport,
 	})
 	if err != nil {
-		log.Println("S3 Client Error")
-		log.Printf("%v\n", Target)
-		log.Fatalln(err)
+		logger.Error("S3 Client Error", slog.Any("error", err))
+		os.Exit(1)
 	}
 
 	// Check bucket
-	log.Println("Checking Bucket Exists")
+	logger.Info("Checking Bucket Exists")
 	found, err := TargetClient.BucketExists(context.Background(), Target.Bucket)
 	if err != nil {
 		errResponse := minio.ToErrorResponse(err)
-		log.Println("S3 Bucket Error")
-		log.Println(errResponse)
-		log.Fatalln(err)
+		logger.Error("S3 Bucket Error", slog.String("error_code", errResponse.Code), slog.Any("error", err))
+		os.Exit(1)
 	} else if !found {
-		log.Fatalln("Bucket does not exist!")
+		logger.Error("Bucket does not exist!")
+		os.Exit(1)
+	}
+
+	// Retention can only be carried over into a bucket with object lock
+	lock, _, _, _, err := TargetClient.GetObjectLockConfig(context.Background(), Target.Bucket)
+	if err != nil && minio.ToErrorResponse(err).Code != "ObjectLockConfigurationNotFoundError" {
+		logger.Error("S3 Object Lock Error", slog.Any("error", err))
+		os.Exit(1)
+	}
+	Target.ObjectLock = lock == "Enabled"
+	if !Target.ObjectLock {
+		logger.Warn("Object lock is not enabled, objects under retention or legal hold will fail to migrate")
+	}
+
+	// Versions can only be replayed into a versioned bucket
+	versioning, err := TargetClient.GetBucketVersioning(context.Background(), Target.Bucket)
+	if err != nil {
+		logger.Warn("Bucket versioning cannot be read", slog.Any("error", err))
 	}
+	Target.Versioning = versioning.Enabled()
 
-	log.Println("S3 Configuration  Complete")
+	applyTargetLifecycle(logger)
 
+	minioStore := storage.NewMinioStore(TargetClient, Target.Bucket)
+	minioStore.Encryption, Target.SSE = serverSideEncryption("TARGET")
+	TargetStore = minioStore
+	logger.Info("S3 Configuration Complete")
 }
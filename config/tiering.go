@@ -0,0 +1,82 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// TieringRule picks the storage class of migrated objects. Directory limits
+// the rule to one directory and MinAgeDays to objects last modified at least
+// that many days ago; an empty field matches everything.
+type TieringRule struct {
+	Directory    string `json:"directory"`
+	MinAgeDays   int    `json:"min_age_days"`
+	StorageClass string `json:"storage_class"`
+}
+
+// TieringRules applied in order, the first matching rule wins
+var TieringRules []TieringRule
+
+const (
+	appTieringRules = "APP_TIERING_RULES"
+	s3Lifecycle     = "S3_TARGET_LIFECYCLE"
+)
+
+// InitializeTiering loads the storage class rules from the JSON file named by
+// APP_TIERING_RULES. Without it objects get the bucket's default class.
+func InitializeTiering() {
+	file, ok := os.LookupEnv(appTieringRules)
+	if !ok || file == "" {
+		return
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		panic(fmt.Sprintf("APP_TIERING_RULES file cannot be read: %v", err))
+	}
+	if err = json.Unmarshal(b, &TieringRules); err != nil {
+		panic(fmt.Sprintf("APP_TIERING_RULES file is not valid JSON: %v", err))
+	}
+	for i, rule := range TieringRules {
+		if rule.StorageClass == "" {
+			panic(fmt.Sprintf("tiering rule %d: storage_class is required", i))
+		}
+		if rule.MinAgeDays < 0 {
+			panic(fmt.Sprintf("tiering rule %d: min_age_days must not be negative", i))
+		}
+	}
+
+	Logger.Info("Tiering rules loaded", slog.Int("rules", len(TieringRules)))
+}
+
+// applyTargetLifecycle replaces the lifecycle rules of the target bucket with
+// the S3 LifecycleConfiguration XML document named by S3_TARGET_LIFECYCLE
+func applyTargetLifecycle(logger *slog.Logger) {
+	file, ok := os.LookupEnv(s3Lifecycle)
+	if !ok || file == "" {
+		return
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		panic(fmt.Sprintf("S3_TARGET_LIFECYCLE file cannot be read: %v", err))
+	}
+	lc := lifecycle.NewConfiguration()
+	if err = xml.Unmarshal(b, lc); err != nil {
+		panic(fmt.Sprintf("S3_TARGET_LIFECYCLE file is not a valid lifecycle configuration: %v", err))
+	}
+
+	if err = TargetClient.SetBucketLifecycle(context.Background(), Target.Bucket, lc); err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		logger.Error("S3 Lifecycle Error", slog.String("error_code", errResponse.Code), slog.Any("error", err))
+		os.Exit(1)
+	}
+	logger.Info("Bucket lifecycle configured", slog.Int("rules", len(lc.Rules)))
+}
@@ -0,0 +1,253 @@
+// Package envelope implements client-side envelope encryption of object
+// streams. Every object gets a random AES-256 data key that encrypts the
+// content in AES-GCM chunks; the data key itself is encrypted ("wrapped")
+// with a master key and stored in the object metadata, so the storage
+// provider never sees plaintext or usable keys.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Metadata keys describing an encrypted object
+const (
+	MetaAlgorithm = "cse-alg"
+	MetaKey       = "cse-key"
+	MetaKeyID     = "cse-key-id"
+	MetaNonce     = "cse-nonce"
+)
+
+// Algorithm identifies the stream format
+const Algorithm = "AES256-GCM-64K"
+
+const (
+	chunkSize = 64 << 10
+	tagSize   = 16
+	keySize   = 32
+	nonceSize = 12
+)
+
+// ErrInvalid is returned for corrupt, truncated or foreign ciphertext
+var ErrInvalid = errors.New("envelope: invalid ciphertext")
+
+// IsEncrypted reports whether metadata describes an envelope encrypted object
+func IsEncrypted(metadata map[string]string) bool {
+	return metadata[MetaAlgorithm] != ""
+}
+
+// KeyID fingerprints a master key so objects show which key wrapped them
+func KeyID(master []byte) string {
+	sum := sha256.Sum256(master)
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// EncryptedSize returns the ciphertext size for n bytes of plaintext
+func EncryptedSize(n int64) int64 {
+	chunks := (n + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return n + chunks*tagSize
+}
+
+// DecryptedSize returns the plaintext size for n bytes of ciphertext
+func DecryptedSize(n int64) int64 {
+	chunks := (n + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return n - chunks*tagSize
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns a reader producing the ciphertext of r and the metadata to
+// store with it
+func Encrypt(master []byte, r io.Reader) (io.Reader, map[string]string, error) {
+	dataKey := make([]byte, keySize)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := wrapKey(master, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata := map[string]string{
+		MetaAlgorithm: Algorithm,
+		MetaKey:       base64.StdEncoding.EncodeToString(wrapped),
+		MetaKeyID:     KeyID(master),
+		MetaNonce:     base64.StdEncoding.EncodeToString(nonce),
+	}
+	return &sealer{aead: aead, nonce: nonce, src: bufio.NewReaderSize(r, chunkSize+1)}, metadata, nil
+}
+
+// Decrypt returns a reader producing the plaintext of r, an object stored
+// with the given metadata
+func Decrypt(master []byte, r io.Reader, metadata map[string]string) (io.Reader, error) {
+	if metadata[MetaAlgorithm] != Algorithm {
+		return nil, fmt.Errorf("envelope: unsupported algorithm %q", metadata[MetaAlgorithm])
+	}
+	if id := metadata[MetaKeyID]; id != "" && id != KeyID(master) {
+		return nil, fmt.Errorf("envelope: object wrapped with key %s", id)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[MetaKey])
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	nonce, err := base64.StdEncoding.DecodeString(metadata[MetaNonce])
+	if err != nil || len(nonce) != nonceSize {
+		return nil, ErrInvalid
+	}
+	dataKey, err := unwrapKey(master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &opener{aead: aead, nonce: nonce, src: bufio.NewReaderSize(r, chunkSize+tagSize+1)}, nil
+}
+
+func wrapKey(master, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func unwrapKey(master, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrInvalid
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return dataKey, nil
+}
+
+// chunkNonce derives a unique nonce per chunk. The final chunk is marked in
+// the additional data so truncating the stream is detected.
+func chunkNonce(base []byte, counter uint64) []byte {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, base)
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(base[4:])^counter)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type sealer struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	src     *bufio.Reader
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func (s *sealer) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, chunkSize)
+		n, err := io.ReadFull(s.src, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		_, peekErr := s.src.Peek(1)
+		final := peekErr != nil
+		if peekErr != nil && peekErr != io.EOF {
+			return 0, peekErr
+		}
+
+		s.buf = s.aead.Seal(nil, chunkNonce(s.nonce, s.counter), chunk[:n], chunkAD(final))
+		s.counter++
+		s.done = final
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+type opener struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	src     *bufio.Reader
+	counter uint64
+	buf     []byte
+	done    bool
+}
+
+func (o *opener) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, chunkSize+tagSize)
+		n, err := io.ReadFull(o.src, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if n < tagSize {
+			return 0, ErrInvalid
+		}
+		_, peekErr := o.src.Peek(1)
+		final := peekErr != nil
+		if peekErr != nil && peekErr != io.EOF {
+			return 0, peekErr
+		}
+
+		plain, err := o.aead.Open(nil, chunkNonce(o.nonce, o.counter), chunk[:n], chunkAD(final))
+		if err != nil {
+			return 0, ErrInvalid
+		}
+		o.buf = plain
+		o.counter++
+		o.done = final
+	}
+
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,144 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testData(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// seal encrypts plain in full and returns the ciphertext and its metadata
+func seal(t *testing.T, master, plain []byte) ([]byte, map[string]string) {
+	t.Helper()
+	r, metadata, err := Encrypt(master, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read ciphertext: %v", err)
+	}
+	return sealed, metadata
+}
+
+// open decrypts sealed in full
+func open(master, sealed []byte, metadata map[string]string) ([]byte, error) {
+	r, err := Decrypt(master, bytes.NewReader(sealed), metadata)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	master := testKey(t)
+	sizes := map[string]int{
+		"empty":         0,
+		"one byte":      1,
+		"chunk minus 1": chunkSize - 1,
+		"chunk":         chunkSize,
+		"chunk plus 1":  chunkSize + 1,
+	}
+	for name, size := range sizes {
+		t.Run(name, func(t *testing.T) {
+			plain := testData(t, size)
+			sealed, metadata := seal(t, master, plain)
+
+			if got, want := int64(len(sealed)), EncryptedSize(int64(size)); got != want {
+				t.Errorf("ciphertext is %d bytes, EncryptedSize says %d", got, want)
+			}
+			if got := DecryptedSize(int64(len(sealed))); got != int64(size) {
+				t.Errorf("DecryptedSize is %d, want %d", got, size)
+			}
+			if !IsEncrypted(metadata) {
+				t.Error("metadata does not mark the object as encrypted")
+			}
+
+			opened, err := open(master, sealed, metadata)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(opened, plain) {
+				t.Fatalf("plaintext differs after round trip")
+			}
+		})
+	}
+}
+
+func TestTruncatedStreamRejected(t *testing.T) {
+	master := testKey(t)
+	plain := testData(t, 2*chunkSize+100)
+	sealed, metadata := seal(t, master, plain)
+
+	cuts := map[string]int{
+		"last chunk dropped": 2 * (chunkSize + tagSize),
+		"mid chunk":          chunkSize + tagSize + 10,
+		"tag cut short":      len(sealed) - 1,
+		"nothing left":       0,
+	}
+	for name, cut := range cuts {
+		t.Run(name, func(t *testing.T) {
+			_, err := open(master, sealed[:cut], metadata)
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("got %v, want ErrInvalid", err)
+			}
+		})
+	}
+}
+
+func TestTamperedChunkRejected(t *testing.T) {
+	master := testKey(t)
+	plain := testData(t, 2*chunkSize+100)
+	sealed, metadata := seal(t, master, plain)
+
+	tampered := bytes.Clone(sealed)
+	tampered[chunkSize+tagSize+5] ^= 0x01
+	if _, err := open(master, tampered, metadata); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("got %v, want ErrInvalid", err)
+	}
+
+	// Swapped chunks fail too, as each is sealed under its own nonce
+	swapped := bytes.Clone(sealed[:2*(chunkSize+tagSize)])
+	copy(swapped, sealed[chunkSize+tagSize:2*(chunkSize+tagSize)])
+	copy(swapped[chunkSize+tagSize:], sealed[:chunkSize+tagSize])
+	swapped = append(swapped, sealed[2*(chunkSize+tagSize):]...)
+	if _, err := open(master, swapped, metadata); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("swapped chunks: got %v, want ErrInvalid", err)
+	}
+}
+
+func TestWrongKeyFails(t *testing.T) {
+	master := testKey(t)
+	other := testKey(t)
+	plain := testData(t, 1000)
+	sealed, metadata := seal(t, master, plain)
+
+	if _, err := open(other, sealed, metadata); err == nil {
+		t.Fatal("decrypted with the wrong key")
+	}
+
+	// Without the key fingerprint the unwrap itself must fail
+	delete(metadata, MetaKeyID)
+	if _, err := open(other, sealed, metadata); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("got %v, want ErrInvalid", err)
+	}
+}
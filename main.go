@@ -3,31 +3,47 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 
 	app "github.com/MidhunRajeevan/s3-migration/app"
 	config "github.com/MidhunRajeevan/s3-migration/config"
 )
 
 func main() {
+	config.InitializeLogger()
 	config.Initializesource()
 	config.InitializeTarget()
 	config.InitializeApp()
+	config.InitializeRewrite()
+	config.InitializeCSE()
+	config.InitializeTiering()
 	config.InitializeDB()
 
 	if config.App.AllowInsecure {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
-	http.HandleFunc(fmt.Sprintf("/%s", config.App.TenantString), app.Uploads)
-	http.HandleFunc(fmt.Sprintf("/%s/", config.App.TenantString), app.Uploads)
+	http.HandleFunc(fmt.Sprintf("/%s", config.App.TenantString), app.RequestID(app.Uploads))
+	http.HandleFunc(fmt.Sprintf("/%s/", config.App.TenantString), app.RequestID(app.Uploads))
 	http.HandleFunc("/", app.Index)
 
 	http.HandleFunc("/start", app.StartMigrationHandler)
 	http.HandleFunc("/stop", app.StopMigrationHandler)
+	http.HandleFunc("/retry-failed", app.RequireAdmin(app.RetryFailedHandler))
+	http.HandleFunc("/rollback", app.RequireAdmin(app.RollbackHandler))
+	http.HandleFunc("/jobs/", app.RequestID(app.RequireAdmin(app.Jobs)))
+	http.HandleFunc("/archives/", app.RequestID(app.Archives))
+
+	app.StartDeletionSweeper()
+	app.StartUploadPurger()
+	app.StartSessionExpirer()
 
 	url := fmt.Sprintf(":%d", config.App.ListenPort)
-	log.Println("Starting server at " + url)
-	log.Fatal(http.ListenAndServe(url, nil))
+	config.Logger.Info("Starting server", slog.String("address", url))
+	if err := http.ListenAndServe(url, nil); err != nil {
+		config.Logger.Error("Server stopped", slog.Any("error", err))
+		os.Exit(1)
+	}
 }
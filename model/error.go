@@ -4,4 +4,6 @@ package model
 type Error struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
+	// Accepted lists the content types an upload may have
+	Accepted []string `json:"accepted,omitempty"`
 }
@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// AzureStore keeps objects as block blobs in an Azure Blob Storage container.
+// Azurite works through its connection string, which makes the adapter
+// testable against a local emulator.
+type AzureStore struct {
+	Client *container.Client
+}
+
+// NewAzureStore for the container reachable through connectionString
+func NewAzureStore(connectionString, containerName string) (*AzureStore, error) {
+	client, err := container.NewClientFromConnectionString(connectionString, containerName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &AzureStore{Client: client}, nil
+}
+
+func azureError(err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+// azureMetadata converts blob metadata to the lower-case map used by
+// ObjectInfo and PutOptions
+func azureMetadata(m map[string]*string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		if v != nil {
+			out[strings.ToLower(k)] = *v
+		}
+	}
+	return out
+}
+
+func azureObjectInfo(key string, size *int64, contentType *string, etag *azcore.ETag, lastModified *time.Time, metadata map[string]*string) ObjectInfo {
+	info := ObjectInfo{Key: key, Metadata: azureMetadata(metadata)}
+	if size != nil {
+		info.Size = *size
+	}
+	if contentType != nil {
+		info.ContentType = *contentType
+	}
+	if etag != nil {
+		info.ETag = strings.Trim(string(*etag), `"`)
+	}
+	if lastModified != nil {
+		info.LastModified = *lastModified
+	}
+	return info
+}
+
+func (s *AzureStore) List(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	out := make(chan ObjectInfo)
+	go func() {
+		defer close(out)
+
+		send := func(info ObjectInfo) bool {
+			select {
+			case out <- info:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		sendItems := func(items []*container.BlobItem) bool {
+			for _, item := range items {
+				// The service has no start-after, only its own markers
+				if *item.Name <= opts.StartAfter {
+					continue
+				}
+				p := item.Properties
+				if !send(azureObjectInfo(*item.Name, p.ContentLength, p.ContentType, p.ETag, p.LastModified, item.Metadata)) {
+					return false
+				}
+			}
+			return true
+		}
+		include := container.ListBlobsInclude{Metadata: true}
+
+		if opts.Recursive {
+			pager := s.Client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+				Prefix:  &opts.Prefix,
+				Include: include,
+			})
+			for pager.More() {
+				page, err := pager.NextPage(ctx)
+				if err != nil {
+					send(ObjectInfo{Err: azureError(err)})
+					return
+				}
+				if !sendItems(page.Segment.BlobItems) {
+					return
+				}
+			}
+			return
+		}
+
+		pager := s.Client.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+			Prefix:  &opts.Prefix,
+			Include: include,
+		})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				send(ObjectInfo{Err: azureError(err)})
+				return
+			}
+			if !sendItems(page.Segment.BlobItems) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (s *AzureStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	props, err := s.Client.NewBlobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		return ObjectInfo{}, azureError(err)
+	}
+	return azureObjectInfo(key, props.ContentLength, props.ContentType, props.ETag, props.LastModified, props.Metadata), nil
+}
+
+func (s *AzureStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	resp, err := s.Client.NewBlobClient(key).DownloadStream(ctx, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, azureError(err)
+	}
+	info := azureObjectInfo(key, resp.ContentLength, resp.ContentType, resp.ETag, resp.LastModified, resp.Metadata)
+	return resp.Body, info, nil
+}
+
+func (s *AzureStore) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+
+	metadata := make(map[string]*string, len(opts.Metadata))
+	for k, v := range opts.Metadata {
+		v := v
+		metadata[k] = &v
+	}
+	uploadOpts := &blockblob.UploadStreamOptions{Metadata: metadata}
+	if opts.ContentType != "" {
+		uploadOpts.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &opts.ContentType}
+	}
+
+	if _, err := s.Client.NewBlockBlobClient(key).UploadStream(ctx, r, uploadOpts); err != nil {
+		return ObjectInfo{}, azureError(err)
+	}
+	return s.Stat(ctx, key)
+}
+
+func (s *AzureStore) Delete(ctx context.Context, key string) error {
+	_, err := s.Client.NewBlobClient(key).Delete(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Copy streams the blob through the service, since a server-side copy is
+// asynchronous and cannot change the content type
+func (s *AzureStore) Copy(ctx context.Context, srcKey, dstKey string, opts PutOptions) (ObjectInfo, error) {
+	r, info, err := s.Get(ctx, srcKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer r.Close()
+
+	if opts.ContentType == "" {
+		opts.ContentType = info.ContentType
+	}
+	if opts.Metadata == nil {
+		opts.Metadata = info.Metadata
+	}
+	return s.Put(ctx, dstKey, r, info.Size, opts)
+}
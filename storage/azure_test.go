@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// azuriteConnStr names the connection string of an Azurite emulator. The
+// tests are skipped without it, test/run.sh starts one and sets it.
+const azuriteConnStr = "AZURITE_CONNECTION_STRING"
+
+// newAzuriteStore returns a store on a fresh container, removed after the test
+func newAzuriteStore(t *testing.T) *AzureStore {
+	t.Helper()
+	connStr := os.Getenv(azuriteConnStr)
+	if connStr == "" {
+		t.Skipf("%s is not set", azuriteConnStr)
+	}
+
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	store, err := NewAzureStore(connStr, name)
+	if err != nil {
+		t.Fatalf("NewAzureStore: %v", err)
+	}
+	ctx := context.Background()
+	if _, err = store.Client.Create(ctx, nil); err != nil {
+		t.Fatalf("create container: %v", err)
+	}
+	t.Cleanup(func() {
+		store.Client.Delete(context.Background(), nil)
+	})
+	return store
+}
+
+func putString(t *testing.T, store ObjectStore, key, content string, opts PutOptions) ObjectInfo {
+	t.Helper()
+	info, err := store.Put(context.Background(), key, bytes.NewReader([]byte(content)), int64(len(content)), opts)
+	if err != nil {
+		t.Fatalf("Put %s: %v", key, err)
+	}
+	return info
+}
+
+func listKeys(t *testing.T, store ObjectStore, opts ListOptions) []string {
+	t.Helper()
+	var keys []string
+	for info := range store.List(context.Background(), opts) {
+		if info.Err != nil {
+			t.Fatalf("List: %v", info.Err)
+		}
+		keys = append(keys, info.Key)
+	}
+	return keys
+}
+
+func TestAzurePutGetStat(t *testing.T) {
+	store := newAzuriteStore(t)
+	ctx := context.Background()
+
+	put := putString(t, store, "dir/hello.txt", "hello", PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"Hash": "abc", "name": "hello.txt"},
+	})
+	if put.Size != 5 || put.ContentType != "text/plain" || put.ETag == "" {
+		t.Errorf("Put returned %+v", put)
+	}
+
+	info, err := store.Stat(ctx, "dir/hello.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 5 || info.ContentType != "text/plain" {
+		t.Errorf("Stat returned %+v", info)
+	}
+	// Metadata keys come back in lower case whatever the service returns
+	if info.Metadata["hash"] != "abc" || info.Metadata["name"] != "hello.txt" {
+		t.Errorf("metadata is %v", info.Metadata)
+	}
+
+	r, got, err := store.Get(ctx, "dir/hello.txt")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(content) != "hello" || got.ETag != info.ETag {
+		t.Errorf("Get returned %q with %+v", content, got)
+	}
+}
+
+func TestAzureNotFound(t *testing.T) {
+	store := newAzuriteStore(t)
+	ctx := context.Background()
+
+	if _, err := store.Stat(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat: got %v, want ErrNotFound", err)
+	}
+	if _, _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: got %v, want ErrNotFound", err)
+	}
+	// Deleting a missing blob is not an error, like on S3
+	if err := store.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+}
+
+func TestAzureList(t *testing.T) {
+	store := newAzuriteStore(t)
+	for _, key := range []string{"a/1", "a/2", "a/b/3", "a/b/4", "c/5"} {
+		putString(t, store, key, key, PutOptions{})
+	}
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []string
+	}{
+		{"recursive", ListOptions{Prefix: "a/", Recursive: true}, []string{"a/1", "a/2", "a/b/3", "a/b/4"}},
+		{"one level", ListOptions{Prefix: "a/"}, []string{"a/1", "a/2"}},
+		{"start after", ListOptions{Prefix: "a/", Recursive: true, StartAfter: "a/2"}, []string{"a/b/3", "a/b/4"}},
+		{"empty prefix", ListOptions{Prefix: "x/", Recursive: true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := listKeys(t, store, tt.opts)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAzureCopyDelete(t *testing.T) {
+	store := newAzuriteStore(t)
+	ctx := context.Background()
+
+	putString(t, store, "src", "content", PutOptions{
+		ContentType: "image/png",
+		Metadata:    map[string]string{"hash": "abc"},
+	})
+
+	copied, err := store.Copy(ctx, "src", "dst", PutOptions{})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if copied.Size != 7 || copied.ContentType != "image/png" || copied.Metadata["hash"] != "abc" {
+		t.Errorf("Copy kept %+v", copied)
+	}
+
+	replaced, err := store.Copy(ctx, "src", "dst2", PutOptions{
+		ContentType: "application/pdf",
+		Metadata:    map[string]string{"url": "/x"},
+	})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if replaced.ContentType != "application/pdf" || replaced.Metadata["url"] != "/x" || replaced.Metadata["hash"] != "" {
+		t.Errorf("Copy with options returned %+v", replaced)
+	}
+
+	if err = store.Delete(ctx, "src"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = store.Stat(ctx, "src"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// metaDir holds the content type and user metadata of each object, mirroring
+// the object tree, so plain exports without it still work
+const metaDir = ".meta"
+
+// FSStore keeps objects as files below a root directory, such as an NFS
+// export or a backup volume
+type FSStore struct {
+	Root string
+}
+
+type fsMeta struct {
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// NewFSStore rooted at an existing directory
+func NewFSStore(root string) (*FSStore, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	return &FSStore{Root: root}, nil
+}
+
+// path maps a key to a file below the root, rejecting keys that escape it
+func (s *FSStore) path(base, key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.HasPrefix(strings.TrimPrefix(clean, "/"), metaDir+"/") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(base, filepath.FromSlash(clean)), nil
+}
+
+func (s *FSStore) objectPath(key string) (string, error) {
+	return s.path(s.Root, key)
+}
+
+func (s *FSStore) metaPath(key string) (string, error) {
+	p, err := s.path(filepath.Join(s.Root, metaDir), key)
+	if err != nil {
+		return "", err
+	}
+	return p + ".json", nil
+}
+
+func fsError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+func (s *FSStore) info(key string, fi fs.FileInfo) ObjectInfo {
+	info := ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+		ETag:         fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s:%d:%d", key, fi.Size(), fi.ModTime().UnixNano())))),
+		Metadata:     map[string]string{},
+	}
+
+	var meta fsMeta
+	if p, err := s.metaPath(key); err == nil {
+		if b, err := os.ReadFile(p); err == nil && json.Unmarshal(b, &meta) == nil {
+			info.ContentType = meta.ContentType
+			info.Metadata = lowerKeys(meta.Metadata)
+		}
+	}
+	if info.ContentType == "" {
+		info.ContentType = mime.TypeByExtension(path.Ext(key))
+	}
+	if info.ContentType == "" {
+		info.ContentType = "application/octet-stream"
+	}
+	return info
+}
+
+func (s *FSStore) List(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	out := make(chan ObjectInfo)
+	go func() {
+		defer close(out)
+
+		// Walk from the deepest directory covered by the prefix
+		start := s.Root
+		if dir := path.Dir("/" + opts.Prefix); dir != "/" {
+			start = filepath.Join(s.Root, filepath.FromSlash(dir))
+		}
+
+		var keys []string
+		err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(s.Root, p)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if d.IsDir() {
+				if key == metaDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasPrefix(key, opts.Prefix) {
+				return nil
+			}
+			if !opts.Recursive && strings.Contains(key[len(opts.Prefix):], "/") {
+				return nil
+			}
+			keys = append(keys, key)
+			return ctx.Err()
+		})
+		if err != nil {
+			select {
+			case out <- ObjectInfo{Err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			if key <= opts.StartAfter {
+				continue
+			}
+			info, err := s.Stat(ctx, key)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				info = ObjectInfo{Err: err}
+			}
+			select {
+			case out <- info:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (s *FSStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, fsError(err)
+	}
+	if fi.IsDir() {
+		return ObjectInfo{}, fmt.Errorf("%w: %s is a directory", ErrNotFound, key)
+	}
+	return s.info(key, fi), nil
+}
+
+// Get returns an *os.File, which also implements io.Seeker
+func (s *FSStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	p, _ := s.objectPath(key)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, fsError(err)
+	}
+	return f, info, nil
+}
+
+func (s *FSStore) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return ObjectInfo{}, err
+	}
+
+	// Write next to the destination and rename so readers never see a
+	// partial file
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	written, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if err = s.writeMeta(key, fsMeta{ContentType: opts.ContentType, Metadata: opts.Metadata}); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return ObjectInfo{}, err
+	}
+	return s.Stat(ctx, key)
+}
+
+func (s *FSStore) writeMeta(key string, meta fsMeta) error {
+	p, err := s.metaPath(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0644)
+}
+
+func (s *FSStore) Delete(ctx context.Context, key string) error {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if p, err = s.metaPath(key); err == nil {
+		os.Remove(p)
+	}
+	return nil
+}
+
+func (s *FSStore) Copy(ctx context.Context, srcKey, dstKey string, opts PutOptions) (ObjectInfo, error) {
+	r, info, err := s.Get(ctx, srcKey)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer r.Close()
+
+	if opts.ContentType == "" {
+		opts.ContentType = info.ContentType
+	}
+	if opts.Metadata == nil {
+		opts.Metadata = info.Metadata
+	}
+	return s.Put(ctx, dstKey, r, info.Size, opts)
+}
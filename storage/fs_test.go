@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFSStore(t *testing.T) *FSStore {
+	t.Helper()
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFSStore: %v", err)
+	}
+	return store
+}
+
+func TestFSPutGetStat(t *testing.T) {
+	store := newTestFSStore(t)
+	ctx := context.Background()
+
+	put := putString(t, store, "dir/hello.txt", "hello", PutOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"Hash": "abc", "name": "hello.txt"},
+	})
+	if put.Size != 5 || put.ContentType != "text/plain" || put.ETag == "" {
+		t.Errorf("Put returned %+v", put)
+	}
+
+	info, err := store.Stat(ctx, "dir/hello.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Size != 5 || info.ContentType != "text/plain" || info.ETag != put.ETag {
+		t.Errorf("Stat returned %+v", info)
+	}
+	if info.Metadata["hash"] != "abc" || info.Metadata["name"] != "hello.txt" {
+		t.Errorf("metadata is %v", info.Metadata)
+	}
+
+	r, got, err := store.Get(ctx, "dir/hello.txt")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer r.Close()
+	if _, ok := r.(io.Seeker); !ok {
+		t.Errorf("Get returned a %T, want an io.Seeker", r)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(content) != "hello" || got.ETag != info.ETag {
+		t.Errorf("Get returned %q with %+v", content, got)
+	}
+}
+
+func TestFSContentType(t *testing.T) {
+	store := newTestFSStore(t)
+	ctx := context.Background()
+
+	putString(t, store, "typed.png", "x", PutOptions{ContentType: "application/pdf"})
+	putString(t, store, "untyped.png", "x", PutOptions{})
+	putString(t, store, "untyped", "x", PutOptions{})
+	// Files put there by other means have no metadata
+	if err := os.WriteFile(filepath.Join(store.Root, "plain.pdf"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"typed.png", "application/pdf"},
+		{"untyped.png", "image/png"},
+		{"untyped", "application/octet-stream"},
+		{"plain.pdf", "application/pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			info, err := store.Stat(ctx, tt.key)
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.ContentType != tt.want {
+				t.Errorf("got %s, want %s", info.ContentType, tt.want)
+			}
+			if info.Metadata == nil {
+				t.Error("metadata is nil")
+			}
+		})
+	}
+}
+
+func TestFSPutShortRead(t *testing.T) {
+	store := newTestFSStore(t)
+	ctx := context.Background()
+
+	if _, err := store.Put(ctx, "short", io.LimitReader(zeros{}, 3), 5, PutOptions{}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Put: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	// A failed put leaves nothing behind
+	if got := listKeys(t, store, ListOptions{Recursive: true}); len(got) != 0 {
+		t.Errorf("listed %v after a failed put", got)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestFSNotFound(t *testing.T) {
+	store := newTestFSStore(t)
+	ctx := context.Background()
+
+	if err := os.Mkdir(filepath.Join(store.Root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"missing", "dir"} {
+		if _, err := store.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat %s: got %v, want ErrNotFound", key, err)
+		}
+		if _, _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get %s: got %v, want ErrNotFound", key, err)
+		}
+	}
+	if err := store.Delete(ctx, "missing"); err != nil {
+		t.Errorf("Delete: %v", err)
+	}
+}
+
+func TestFSInvalidKey(t *testing.T) {
+	store := newTestFSStore(t)
+	ctx := context.Background()
+
+	// Keys are confined to the root, and the metadata tree is not an object
+	for _, key := range []string{"", "/", "..", ".meta/x.json", "a/../.meta/x.json"} {
+		t.Run(key, func(t *testing.T) {
+			if _, err := store.Put(ctx, key, io.LimitReader(zeros{}, 1), 1, PutOptions{}); err == nil {
+				t.Error("Put succeeded")
+			}
+			if _, err := store.Stat(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Stat: got %v, want an invalid key", err)
+			}
+		})
+	}
+
+	// A key climbing out of the root stays below it
+	putString(t, store, "../../escaped", "x", PutOptions{})
+	if _, err := os.Stat(filepath.Join(store.Root, "escaped")); err != nil {
+		t.Errorf("escaping key was not kept below the root: %v", err)
+	}
+}
+
+func TestFSList(t *testing.T) {
+	store := newTestFSStore(t)
+	for _, key := range []string{"a/2", "a/1", "a/b/4", "a/b/3", "a/10", "ab/6", "c/5"} {
+		putString(t, store, key, key, PutOptions{ContentType: "text/plain"})
+	}
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []string
+	}{
+		{"recursive", ListOptions{Prefix: "a/", Recursive: true}, []string{"a/1", "a/10", "a/2", "a/b/3", "a/b/4"}},
+		{"one level", ListOptions{Prefix: "a/"}, []string{"a/1", "a/10", "a/2"}},
+		{"partial name", ListOptions{Prefix: "a", Recursive: true}, []string{"a/1", "a/10", "a/2", "a/b/3", "a/b/4", "ab/6"}},
+		{"partial name, one level", ListOptions{Prefix: "a/b/"}, []string{"a/b/3", "a/b/4"}},
+		{"start after", ListOptions{Prefix: "a/", Recursive: true, StartAfter: "a/2"}, []string{"a/b/3", "a/b/4"}},
+		{"start after a missing key", ListOptions{Prefix: "a/", Recursive: true, StartAfter: "a/1z"}, []string{"a/2", "a/b/3", "a/b/4"}},
+		{"everything without metadata", ListOptions{Recursive: true}, []string{"a/1", "a/10", "a/2", "a/b/3", "a/b/4", "ab/6", "c/5"}},
+		{"empty prefix", ListOptions{Prefix: "x/", Recursive: true}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := listKeys(t, store, tt.opts)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFSCopyDelete(t *testing.T) {
+	store := newTestFSStore(t)
+	ctx := context.Background()
+
+	putString(t, store, "src", "content", PutOptions{
+		ContentType: "image/png",
+		Metadata:    map[string]string{"hash": "abc"},
+	})
+
+	copied, err := store.Copy(ctx, "src", "dir/dst", PutOptions{})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if copied.Size != 7 || copied.ContentType != "image/png" || copied.Metadata["hash"] != "abc" {
+		t.Errorf("Copy kept %+v", copied)
+	}
+
+	replaced, err := store.Copy(ctx, "src", "dst2", PutOptions{
+		ContentType: "application/pdf",
+		Metadata:    map[string]string{"url": "/x"},
+	})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if replaced.ContentType != "application/pdf" || replaced.Metadata["url"] != "/x" || replaced.Metadata["hash"] != "" {
+		t.Errorf("Copy with options returned %+v", replaced)
+	}
+
+	if err = store.Delete(ctx, "src"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = store.Stat(ctx, "src"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete: got %v, want ErrNotFound", err)
+	}
+	// The metadata goes with the file
+	putString(t, store, "src", "again", PutOptions{})
+	if info, err := store.Stat(ctx, "src"); err != nil || info.ContentType != "application/octet-stream" || len(info.Metadata) != 0 {
+		t.Errorf("Stat of a new object under a deleted key: %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,397 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// streamPartSize of multipart uploads of unknown size. It bounds the memory
+// a streamed upload holds and allows objects of up to 160 GiB.
+const streamPartSize = 16 << 20
+
+// MinioStore keeps objects in one bucket of an S3 compatible service
+type MinioStore struct {
+	Client *minio.Client
+	Bucket string
+	// Encryption is applied to every write. SSE-C keys are also sent on
+	// reads, as the service cannot decrypt without them.
+	Encryption encrypt.ServerSide
+}
+
+// readEncryption returns the encryption reads must present
+func (s *MinioStore) readEncryption() encrypt.ServerSide {
+	if s.Encryption != nil && s.Encryption.Type() == encrypt.SSEC {
+		return s.Encryption
+	}
+	return nil
+}
+
+// NewMinioStore for the bucket reachable through client
+func NewMinioStore(client *minio.Client, bucket string) *MinioStore {
+	return &MinioStore{Client: client, Bucket: bucket}
+}
+
+func minioObjectInfo(info minio.ObjectInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:            info.Key,
+		Size:           info.Size,
+		ContentType:    info.ContentType,
+		ETag:           info.ETag,
+		LastModified:   info.LastModified,
+		Metadata:       lowerKeys(info.UserMetadata),
+		Retention:      minioRetention(info.Metadata),
+		VersionID:      info.VersionID,
+		IsDeleteMarker: info.IsDeleteMarker,
+		Err:            info.Err,
+	}
+}
+
+// minioRetention reads the object lock headers returned by Stat and Get
+func minioRetention(h http.Header) Retention {
+	r := Retention{
+		Mode:      h.Get("X-Amz-Object-Lock-Mode"),
+		LegalHold: h.Get("X-Amz-Object-Lock-Legal-Hold") == string(minio.LegalHoldEnabled),
+	}
+	if until, err := time.Parse(time.RFC3339, h.Get("X-Amz-Object-Lock-Retain-Until-Date")); err == nil {
+		r.RetainUntil = until
+	}
+	return r
+}
+
+// minioError marks missing keys with ErrNotFound and keeps the S3 error in
+// the chain
+func minioError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket", "NoSuchUpload":
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+func (s *MinioStore) List(ctx context.Context, opts ListOptions) <-chan ObjectInfo {
+	out := make(chan ObjectInfo)
+	go func() {
+		defer close(out)
+		send := func(info ObjectInfo) bool {
+			select {
+			case out <- info:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// S3 lists the versions of a key newest first, so they are held back
+		// until the key changes and sent in reverse
+		var versions []ObjectInfo
+		flush := func() bool {
+			for i := len(versions) - 1; i >= 0; i-- {
+				if !send(versions[i]) {
+					return false
+				}
+			}
+			versions = versions[:0]
+			return true
+		}
+
+		for info := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{
+			Prefix:       opts.Prefix,
+			Recursive:    opts.Recursive,
+			WithVersions: opts.Versions,
+			StartAfter:   opts.StartAfter,
+		}) {
+			if !opts.Versions || info.Err != nil {
+				if !flush() || !send(minioObjectInfo(info)) {
+					return
+				}
+				continue
+			}
+			if len(versions) > 0 && versions[0].Key != info.Key && !flush() {
+				return
+			}
+			versions = append(versions, minioObjectInfo(info))
+		}
+		flush()
+	}()
+	return out
+}
+
+func (s *MinioStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, key, minio.StatObjectOptions{
+		ServerSideEncryption: s.readEncryption(),
+	})
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return minioObjectInfo(info), nil
+}
+
+// Get returns a *minio.Object, which also implements io.Seeker
+func (s *MinioStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	object, err := s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{
+		ServerSideEncryption: s.readEncryption(),
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, minioError(err)
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, minioError(err)
+	}
+	return object, minioObjectInfo(info), nil
+}
+
+// GetVersion returns a *minio.Object of one version of the object
+func (s *MinioStore) GetVersion(ctx context.Context, key, versionID string) (io.ReadCloser, ObjectInfo, error) {
+	object, err := s.Client.GetObject(ctx, s.Bucket, key, minio.GetObjectOptions{
+		ServerSideEncryption: s.readEncryption(),
+		VersionID:            versionID,
+	})
+	if err != nil {
+		return nil, ObjectInfo{}, minioError(err)
+	}
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, ObjectInfo{}, minioError(err)
+	}
+	return object, minioObjectInfo(info), nil
+}
+
+func (s *MinioStore) Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error) {
+	putOpts := minio.PutObjectOptions{
+		ContentType:          opts.ContentType,
+		UserMetadata:         opts.Metadata,
+		StorageClass:         opts.StorageClass,
+		ServerSideEncryption: s.Encryption,
+	}
+	if size < 0 {
+		// Without a size minio-go buffers parts sized for a 5 TiB object
+		putOpts.PartSize = streamPartSize
+	}
+	if !opts.Retention.IsZero() {
+		// Object lock buckets reject writes without a content checksum
+		putOpts.SendContentMd5 = true
+		putOpts.Mode = minio.RetentionMode(opts.Retention.Mode)
+		putOpts.RetainUntilDate = opts.Retention.RetainUntil
+		if opts.Retention.LegalHold {
+			putOpts.LegalHold = minio.LegalHoldEnabled
+		}
+	}
+	upload, err := s.Client.PutObject(ctx, s.Bucket, key, r, size, putOpts)
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return ObjectInfo{
+		Key:          upload.Key,
+		Size:         upload.Size,
+		ContentType:  opts.ContentType,
+		ETag:         upload.ETag,
+		LastModified: upload.LastModified,
+		Metadata:     lowerKeys(opts.Metadata),
+		Retention:    opts.Retention,
+		VersionID:    upload.VersionID,
+	}, nil
+}
+
+func (s *MinioStore) Delete(ctx context.Context, key string) error {
+	return s.Client.RemoveObject(ctx, s.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+// PutDeleteMarker removes key without a version ID, which makes a versioned
+// bucket add a delete marker. The multi-object delete API is used as it is
+// the one reporting the marker's version ID.
+func (s *MinioStore) PutDeleteMarker(ctx context.Context, key string) (string, error) {
+	objects := make(chan minio.ObjectInfo, 1)
+	objects <- minio.ObjectInfo{Key: key}
+	close(objects)
+
+	for result := range s.Client.RemoveObjectsWithResult(ctx, s.Bucket, objects, minio.RemoveObjectsOptions{}) {
+		if result.Err != nil {
+			return "", minioError(result.Err)
+		}
+		if !result.DeleteMarker {
+			return "", fmt.Errorf("no delete marker created for %s, is versioning enabled?", key)
+		}
+		return result.DeleteMarkerVersionID, nil
+	}
+	return "", fmt.Errorf("no delete result for %s", key)
+}
+
+func (s *MinioStore) NewMultipartUpload(ctx context.Context, key string, opts PutOptions) (string, error) {
+	core := minio.Core{Client: s.Client}
+	return core.NewMultipartUpload(ctx, s.Bucket, key, minio.PutObjectOptions{
+		ContentType:          opts.ContentType,
+		UserMetadata:         opts.Metadata,
+		StorageClass:         opts.StorageClass,
+		ServerSideEncryption: s.Encryption,
+	})
+}
+
+func (s *MinioStore) PutPart(ctx context.Context, key, uploadID string, number int, r io.Reader, size int64) (Part, error) {
+	core := minio.Core{Client: s.Client}
+	part, err := core.PutObjectPart(ctx, s.Bucket, key, uploadID, number, r, size, minio.PutObjectPartOptions{
+		SSE: s.readEncryption(),
+	})
+	if err != nil {
+		return Part{}, minioError(err)
+	}
+	return Part{Number: part.PartNumber, ETag: part.ETag, Size: part.Size}, nil
+}
+
+func (s *MinioStore) CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (ObjectInfo, error) {
+	core := minio.Core{Client: s.Client}
+	complete := make([]minio.CompletePart, 0, len(parts))
+	for _, part := range parts {
+		complete = append(complete, minio.CompletePart{PartNumber: part.Number, ETag: part.ETag})
+	}
+	_, err := core.CompleteMultipartUpload(ctx, s.Bucket, key, uploadID, complete, minio.PutObjectOptions{
+		ServerSideEncryption: s.readEncryption(),
+	})
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return s.Stat(ctx, key)
+}
+
+func (s *MinioStore) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	core := minio.Core{Client: s.Client}
+	return minioError(core.AbortMultipartUpload(ctx, s.Bucket, key, uploadID))
+}
+
+func (s *MinioStore) Copy(ctx context.Context, srcKey, dstKey string, opts PutOptions) (ObjectInfo, error) {
+	dst := minio.CopyDestOptions{Bucket: s.Bucket, Object: dstKey, Encryption: s.Encryption}
+	src := minio.CopySrcOptions{Bucket: s.Bucket, Object: srcKey}
+	if sse := s.readEncryption(); sse != nil {
+		src.Encryption = encrypt.SSECopy(sse)
+	}
+	if !opts.Retention.IsZero() {
+		dst.Mode = minio.RetentionMode(opts.Retention.Mode)
+		dst.RetainUntilDate = opts.Retention.RetainUntil
+		if opts.Retention.LegalHold {
+			dst.LegalHold = minio.LegalHoldEnabled
+		}
+	}
+	// minio-go only sends the storage class along with replaced metadata,
+	// which is then carried over from the source unless opts sets it
+	if opts.ContentType != "" || opts.Metadata != nil || opts.StorageClass != "" {
+		contentType, metadata := opts.ContentType, opts.Metadata
+		if contentType == "" || metadata == nil {
+			src, err := s.Stat(ctx, srcKey)
+			if err != nil {
+				return ObjectInfo{}, err
+			}
+			if contentType == "" {
+				contentType = src.ContentType
+			}
+			if metadata == nil {
+				metadata = src.Metadata
+			}
+		}
+		dst.ReplaceMetadata = true
+		dst.UserMetadata = map[string]string{"Content-Type": contentType}
+		if opts.StorageClass != "" {
+			dst.UserMetadata["X-Amz-Storage-Class"] = opts.StorageClass
+		}
+		for k, v := range metadata {
+			dst.UserMetadata[k] = v
+		}
+	}
+
+	_, err := s.Client.CopyObject(ctx, dst, src)
+	if err != nil {
+		return ObjectInfo{}, minioError(err)
+	}
+	return s.Stat(ctx, dstKey)
+}
+
+// presignable reports whether clients can use signed requests on their own.
+// SSE-C keys would have to be handed to them.
+func (s *MinioStore) presignable() error {
+	if s.readEncryption() != nil {
+		return ErrPresignNotSupported
+	}
+	return nil
+}
+
+func (s *MinioStore) PresignGet(ctx context.Context, key string, expires time.Duration, response url.Values) (PresignedRequest, error) {
+	if err := s.presignable(); err != nil {
+		return PresignedRequest{}, err
+	}
+	u, err := s.Client.PresignedGetObject(ctx, s.Bucket, key, expires, response)
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+	return PresignedRequest{Method: http.MethodGet, URL: u.String(), Expires: time.Now().Add(expires)}, nil
+}
+
+// PresignPut signs the content type, the length when known and the
+// encryption headers, which the client must send as returned
+func (s *MinioStore) PresignPut(ctx context.Context, key string, expires time.Duration, opts PresignOptions) (PresignedRequest, error) {
+	if err := s.presignable(); err != nil {
+		return PresignedRequest{}, err
+	}
+	header := make(http.Header)
+	if opts.ContentType != "" {
+		header.Set("Content-Type", opts.ContentType)
+	}
+	if opts.Size > 0 {
+		header.Set("Content-Length", strconv.FormatInt(opts.Size, 10))
+	}
+	if s.Encryption != nil {
+		s.Encryption.Marshal(header)
+	}
+	u, err := s.Client.PresignHeader(ctx, http.MethodPut, s.Bucket, key, expires, nil, header)
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+	return PresignedRequest{
+		Method:  http.MethodPut,
+		URL:     u.String(),
+		Header:  flattenHeader(header),
+		Expires: time.Now().Add(expires),
+	}, nil
+}
+
+// PresignPost leaves encryption to the bucket default, as the policy cannot
+// carry conditions for the encryption fields and S3 rejects fields without one
+func (s *MinioStore) PresignPost(ctx context.Context, key string, expires time.Duration, opts PresignOptions) (PresignedRequest, error) {
+	if err := s.presignable(); err != nil {
+		return PresignedRequest{}, err
+	}
+	expiresAt := time.Now().Add(expires)
+	policy := minio.NewPostPolicy()
+	if err := policy.SetBucket(s.Bucket); err != nil {
+		return PresignedRequest{}, err
+	}
+	if err := policy.SetKey(key); err != nil {
+		return PresignedRequest{}, err
+	}
+	if err := policy.SetExpires(expiresAt.UTC()); err != nil {
+		return PresignedRequest{}, err
+	}
+	if opts.ContentType != "" {
+		if err := policy.SetContentType(opts.ContentType); err != nil {
+			return PresignedRequest{}, err
+		}
+	}
+	if opts.MaxSize > 0 {
+		if err := policy.SetContentLengthRange(1, opts.MaxSize); err != nil {
+			return PresignedRequest{}, err
+		}
+	}
+	u, fields, err := s.Client.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return PresignedRequest{}, err
+	}
+	return PresignedRequest{Method: http.MethodPost, URL: u.String(), Fields: fields, Expires: expiresAt}, nil
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in the store
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// Metadata holds user metadata with lower-case keys
+	Metadata map[string]string
+	// Retention is the object lock state, only known after Stat or Get
+	Retention Retention
+	// VersionID and IsDeleteMarker are set by versioned stores
+	VersionID      string
+	IsDeleteMarker bool
+	// Err is set on listing entries when the listing failed
+	Err error
+}
+
+// Retention is the WORM state of an object under S3 object lock
+type Retention struct {
+	// Mode is GOVERNANCE or COMPLIANCE, empty without a retention period
+	Mode        string
+	RetainUntil time.Time
+	LegalHold   bool
+}
+
+// IsZero reports whether the object is free of retention and legal hold
+func (r Retention) IsZero() bool {
+	return r.Mode == "" && r.RetainUntil.IsZero() && !r.LegalHold
+}
+
+// Equal compares retention to the second, the precision S3 keeps
+func (r Retention) Equal(o Retention) bool {
+	return r.Mode == o.Mode && r.LegalHold == o.LegalHold &&
+		r.RetainUntil.Truncate(time.Second).Equal(o.RetainUntil.Truncate(time.Second))
+}
+
+// ListOptions narrows a listing
+type ListOptions struct {
+	Prefix    string
+	Recursive bool
+	// Versions lists every version and delete marker, oldest first within
+	// a key. Only versioned stores support it.
+	Versions bool
+	// StartAfter skips the keys up to and including it
+	StartAfter string
+}
+
+// PutOptions for writing an object
+type PutOptions struct {
+	ContentType string
+	Metadata    map[string]string
+	// StorageClass such as STANDARD_IA or GLACIER_IR; backends without
+	// storage classes ignore it
+	StorageClass string
+	// Retention to lock the object with; backends without object lock
+	// ignore it
+	Retention Retention
+}
+
+// ObjectStore is a flat key/value store of objects such as an S3 bucket or a
+// directory tree
+type ObjectStore interface {
+	// List streams the objects matching opts in key order. The channel is
+	// closed when the listing ends; a failure is reported as an entry with
+	// Err set.
+	List(ctx context.Context, opts ListOptions) <-chan ObjectInfo
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// Get opens the object for reading. The caller must close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Put writes size bytes from r, or until EOF when size is -1
+	Put(ctx context.Context, key string, r io.Reader, size int64, opts PutOptions) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// Copy duplicates an object within the store. The content type and
+	// metadata of the source are kept unless set in opts.
+	Copy(ctx context.Context, srcKey, dstKey string, opts PutOptions) (ObjectInfo, error)
+}
+
+// VersionedStore is implemented by stores that keep every version of an
+// object, such as S3 buckets with versioning enabled
+type VersionedStore interface {
+	ObjectStore
+	// GetVersion opens one version of an object
+	GetVersion(ctx context.Context, key, versionID string) (io.ReadCloser, ObjectInfo, error)
+	// PutDeleteMarker hides the current version of key and returns the
+	// version ID of the marker
+	PutDeleteMarker(ctx context.Context, key string) (string, error)
+}
+
+// Part of a multipart upload
+type Part struct {
+	Number int
+	ETag   string
+	Size   int64
+}
+
+// MultipartStore is implemented by stores that assemble an object from parts
+// uploaded separately, such as S3 multipart uploads. All parts but the last
+// must be at least MinPartSize bytes.
+type MultipartStore interface {
+	ObjectStore
+	// NewMultipartUpload starts an upload of key and returns its ID
+	NewMultipartUpload(ctx context.Context, key string, opts PutOptions) (string, error)
+	// PutPart uploads size bytes from r as part number of the upload
+	PutPart(ctx context.Context, key, uploadID string, number int, r io.Reader, size int64) (Part, error)
+	// CompleteMultipartUpload joins the parts, in order, into the object
+	CompleteMultipartUpload(ctx context.Context, key, uploadID string, parts []Part) (ObjectInfo, error)
+	// AbortMultipartUpload discards the upload and its parts
+	AbortMultipartUpload(ctx context.Context, key, uploadID string) error
+}
+
+// MinPartSize of every part of a multipart upload except the last
+const MinPartSize = 5 << 20
+
+// ErrPresignNotSupported is returned when the store cannot sign a request a
+// client could send on its own, such as with SSE-C keys
+var ErrPresignNotSupported = errors.New("presigned requests not supported")
+
+// PresignedRequest is a request a client sends straight to the store
+type PresignedRequest struct {
+	Method string            `json:"method"`
+	URL    string            `json:"url"`
+	Header map[string]string `json:"headers,omitempty"`
+	// Fields of a POST form, sent before the file field
+	Fields  map[string]string `json:"fields,omitempty"`
+	Expires time.Time         `json:"expires"`
+}
+
+// PresignOptions constrain a presigned upload
+type PresignOptions struct {
+	ContentType string
+	// Size is the exact length of a PUT body, 0 when unknown
+	Size int64
+	// MaxSize bounds the file of a POST form
+	MaxSize int64
+}
+
+// PresignStore is implemented by stores that sign requests for clients to
+// transfer objects without the gateway, such as S3 buckets
+type PresignStore interface {
+	ObjectStore
+	// PresignGet signs a download of key. response overrides headers of the
+	// response, e.g. response-content-disposition.
+	PresignGet(ctx context.Context, key string, expires time.Duration, response url.Values) (PresignedRequest, error)
+	// PresignPut signs an upload of key with a PUT request
+	PresignPut(ctx context.Context, key string, expires time.Duration, opts PresignOptions) (PresignedRequest, error)
+	// PresignPost signs a POST policy for a browser form upload of key
+	PresignPost(ctx context.Context, key string, expires time.Duration, opts PresignOptions) (PresignedRequest, error)
+}
+
+// flattenHeader keeps the first value of each header
+func flattenHeader(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k := range h {
+		out[k] = h.Get(k)
+	}
+	return out
+}
+
+// lowerKeys returns a copy of m with lower-case keys
+func lowerKeys(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
@@ -10,31 +10,71 @@ import (
 // BadRequest response
 func BadRequest(w *http.ResponseWriter, msg string) {
 	error := model.Error{Code: 400, Message: msg}
-	(*w).WriteHeader(http.StatusBadRequest)
 	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusBadRequest)
 	json.NewEncoder(*w).Encode(error)
 }
 
 // NotFound response
 func NotFound(w *http.ResponseWriter, msg string) {
 	error := model.Error{Code: 404, Message: msg}
+	(*w).Header().Set("Content-Type", "application/json")
 	(*w).WriteHeader(http.StatusNotFound)
+	json.NewEncoder(*w).Encode(error)
+}
+
+// Forbidden response
+func Forbidden(w *http.ResponseWriter, msg string) {
+	error := model.Error{Code: 403, Message: msg}
 	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusForbidden)
 	json.NewEncoder(*w).Encode(error)
 }
 
 // MethodNotAllowed response
 func MethodNotAllowed(w *http.ResponseWriter, msg string) {
 	error := model.Error{Code: 405, Message: msg}
+	(*w).Header().Set("Content-Type", "application/json")
 	(*w).WriteHeader(http.StatusMethodNotAllowed)
+	json.NewEncoder(*w).Encode(error)
+}
+
+// NotAcceptable response
+func NotAcceptable(w *http.ResponseWriter, msg string) {
+	error := model.Error{Code: 406, Message: msg}
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusNotAcceptable)
+	json.NewEncoder(*w).Encode(error)
+}
+
+// UnsupportedMediaType response, listing the accepted types
+func UnsupportedMediaType(w *http.ResponseWriter, msg string, accepted []string) {
+	error := model.Error{Code: 415, Message: msg, Accepted: accepted}
 	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusUnsupportedMediaType)
 	json.NewEncoder(*w).Encode(error)
 }
 
 // InternalServerError response
 func InternalServerError(w *http.ResponseWriter, msg string) {
 	error := model.Error{Code: 500, Message: msg}
+	(*w).Header().Set("Content-Type", "application/json")
 	(*w).WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(*w).Encode(error)
+}
+
+// Conflict response
+func Conflict(w *http.ResponseWriter, msg string) {
+	error := model.Error{Code: 409, Message: msg}
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusConflict)
+	json.NewEncoder(*w).Encode(error)
+}
+
+// NotImplemented response
+func NotImplemented(w *http.ResponseWriter, msg string) {
+	error := model.Error{Code: 501, Message: msg}
 	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusNotImplemented)
 	json.NewEncoder(*w).Encode(error)
 }